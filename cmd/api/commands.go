@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/config"
+	detection "github.com/jasimvs/sample-go-svc/internal/detection"
+	"github.com/jasimvs/sample-go-svc/internal/transaction"
+)
+
+// runBacktest implements `app backtest -from 2025-05-01 -to 2025-05-02 [-rules candidate.yaml]`. It
+// replays the stored transactions through the candidate rules, or the configured ones, and prints the
+// report as JSON.
+func runBacktest(args []string) {
+	flags := flag.NewFlagSet("backtest", flag.ExitOnError)
+	fromFlag := flags.String("from", "", "Start of the range, inclusive (RFC 3339 or YYYY-MM-DD)")
+	toFlag := flags.String("to", "", "End of the range, exclusive (RFC 3339 or YYYY-MM-DD)")
+	rulesFlag := flags.String("rules", "", "YAML or JSON file with the candidate rules section; defaults to the configured rules")
+	_ = flags.Parse(args)
+
+	from, err := detection.ParseBacktestTime(*fromFlag)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	to, err := detection.ParseBacktestTime(*toFlag)
+	if err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+
+	cfg, err := config.LoadConfig("./config")
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	rules := cfg.Detection.Rules
+	if *rulesFlag != "" {
+		if rules, err = loadRules(*rulesFlag); err != nil {
+			log.Fatalf("Invalid candidate rules: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	db, detectionRepo := openDetectionRepository(ctx, cfg.Database)
+	defer db.Close()
+
+	report, err := detection.NewBacktester(detectionRepo).Run(ctx, rules, from, to)
+	if err != nil {
+		log.Fatalf("Backtest failed: %v", err) //nolint:gocritic,exitAfterDefer
+	}
+	printJSON(report)
+}
+
+// runRescan implements `app rescan [-user user_1] [-from 2025-05-01] [-to 2025-05-02] [-rule RapidTransfers]`.
+// It re-evaluates the selected analyzed transactions with the configured rules, stores the new verdicts
+// and prints what changed as JSON.
+func runRescan(args []string) {
+	flags := flag.NewFlagSet("rescan", flag.ExitOnError)
+	userFlag := flags.String("user", "", "Only this user's transactions")
+	fromFlag := flags.String("from", "", "Start of the range, inclusive (RFC 3339 or YYYY-MM-DD)")
+	toFlag := flags.String("to", "", "End of the range, exclusive (RFC 3339 or YYYY-MM-DD)")
+	ruleFlag := flags.String("rule", "", "The changed rule, which must be in the configured rules")
+	_ = flags.Parse(args)
+
+	filter := detection.RescanFilter{UserID: *userFlag, Rule: *ruleFlag}
+	for _, bound := range []struct {
+		name  string
+		value string
+		dest  **time.Time
+	}{{"from", *fromFlag, &filter.From}, {"to", *toFlag, &filter.To}} {
+		if bound.value == "" {
+			continue
+		}
+		parsed, err := detection.ParseBacktestTime(bound.value)
+		if err != nil {
+			log.Fatalf("Invalid -%s: %v", bound.name, err)
+		}
+		*bound.dest = &parsed
+	}
+
+	cfg, err := config.LoadConfig("./config")
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	ctx := context.Background()
+	db, detectionRepo := openDetectionRepository(ctx, cfg.Database)
+	defer db.Close()
+
+	rules, err := detection.BuildRules(cfg.Detection.Rules, detectionRepo)
+	if err != nil {
+		log.Fatalf("Invalid detection rules: %v", err) //nolint:gocritic,exitAfterDefer
+	}
+	version := cfg.Detection.Rules.Version()
+	if err := detection.NewSQLiteRuleVersionRepository(db).Save(ctx, version, cfg.Detection.Rules); err != nil {
+		log.Fatalf("Failed to save rule version: %v", err)
+	}
+	manager := detection.NewManager(detectionRepo)
+	manager.SetRules(version, rules, detection.NewRiskBands(cfg.Detection.Rules.Bands))
+
+	report, err := manager.Rescan(ctx, filter)
+	if err != nil {
+		log.Fatalf("Rescan failed: %v", err)
+	}
+	printJSON(report)
+}
+
+// openDetectionRepository connects to the database and brings its schema up to date, for the
+// subcommands that run without the server.
+func openDetectionRepository(ctx context.Context, cfg config.Database) (*sql.DB, detection.Repository) {
+	db, err := newSQLiteConnection(cfg)
+	if err != nil {
+		log.Fatalf("Error establishing database connection: %v", err)
+	}
+	if err := transaction.NewSQLiteRepository(db).Migrate(ctx); err != nil {
+		log.Fatalf("Database migration failed: %v", err)
+	}
+	for name, migrate := range map[string]func(context.Context) error{
+		"rule stats":    detection.NewSQLiteRuleStatsRepository(db).Migrate,
+		"rule versions": detection.NewSQLiteRuleVersionRepository(db).Migrate,
+	} {
+		if err := migrate(ctx); err != nil {
+			log.Fatalf("%s migration failed: %v", name, err)
+		}
+	}
+	detectionRepo, err := detection.NewSQLiteRepository(db)
+	if err != nil {
+		log.Fatalf("Failed to create detection repository: %v", err)
+	}
+	return db, detectionRepo
+}
+
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+}
+
+func loadRules(path string) (config.Rules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return config.Rules{}, err
+	}
+	defer file.Close()
+
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	if format == "yml" {
+		format = "yaml"
+	}
+	rules, err := config.ParseRules(format, file)
+	if err != nil {
+		return config.Rules{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
@@ -10,12 +10,12 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/jasimvs/sample-go-svc/config"
 	detection "github.com/jasimvs/sample-go-svc/internal/detection"
-	"github.com/jasimvs/sample-go-svc/internal/model"
 	"github.com/jasimvs/sample-go-svc/internal/transaction"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -23,6 +23,17 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backtest":
+			runBacktest(os.Args[2:])
+			return
+		case "rescan":
+			runRescan(os.Args[2:])
+			return
+		}
+	}
+
 	cfgPath := "./config"
 	cfg, err := config.LoadConfig(cfgPath)
 	if err != nil {
@@ -49,6 +60,18 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create detection repository: %v", err)
 	}
+	deadLetterRepo := detection.NewSQLiteDeadLetterRepository(db)
+	if err := deadLetterRepo.Migrate(ctx); err != nil {
+		log.Fatalf("Dead letter migration failed: %v", err)
+	}
+	ruleStatsRepo := detection.NewSQLiteRuleStatsRepository(db)
+	if err := ruleStatsRepo.Migrate(ctx); err != nil {
+		log.Fatalf("Rule stats migration failed: %v", err)
+	}
+	ruleVersionRepo := detection.NewSQLiteRuleVersionRepository(db)
+	if err := ruleVersionRepo.Migrate(ctx); err != nil {
+		log.Fatalf("Rule versions migration failed: %v", err)
+	}
 
 	// --- Echo Instance & Middleware ---
 	e := echo.New()
@@ -56,19 +79,52 @@ func main() {
 	e.Use(middleware.Recover())
 	e.Use(middleware.BodyLimit("1M")) // Good practice for POST
 
-	// --- Handlers ---
-	transactionChannel := make(chan model.Transaction)
+	// Rules read through the window store when it is enabled; everything else uses the database directly.
+	var rulesRepo detection.Repository = detectionRepo
+	if ws := cfg.Detection.WindowStore; ws.Enabled {
+		store := detection.NewWindowStore(detectionRepo, ws.Retention)
+		if err := store.Warm(ctx); err != nil {
+			log.Fatalf("Failed to warm window store: %v", err)
+		}
+		rulesRepo = store
+	}
 
-	txService := transaction.NewService(txRepo, transactionChannel)
-	txHandler := transaction.NewHandler(txService)
-	detectionHandler := detection.NewHandler(detectionRepo)
+	rules, err := detection.BuildRules(cfg.Detection.Rules, rulesRepo)
+	if err != nil {
+		log.Fatalf("Invalid detection rules: %v", err)
+	}
+	if err := ruleVersionRepo.Save(ctx, cfg.Detection.Rules.Version(), cfg.Detection.Rules); err != nil {
+		log.Fatalf("Failed to save rule version: %v", err)
+	}
+	manager := detection.NewManager(rulesRepo)
+	manager.SetRules(cfg.Detection.Rules.Version(), rules, detection.NewRiskBands(cfg.Detection.Rules.Bands))
+	watchRules(cfg.Detection.Rules, manager, rulesRepo, ruleVersionRepo)
+	manager.Run(ctx, cfg.Detection.Workers.Count, cfg.Detection.Workers.QueueDepth)
 
-	highVolRule := detection.NewHighVolumeRule()
-	freqSmallRule := detection.NewFrequentSmallTransactionsRule(detectionRepo, 10, 100.0, 1*time.Hour)
-	rapidTransRule := detection.NewRapidTransfersRule(detectionRepo, 3, 5*time.Minute)
+	outboxCfg, retryCfg := cfg.Detection.Outbox, cfg.Detection.Retry
+	retryPolicy := detection.RetryPolicy{
+		MaxAttempts:    retryCfg.MaxAttempts,
+		InitialBackoff: retryCfg.InitialBackoff,
+		MaxBackoff:     retryCfg.MaxBackoff,
+		Multiplier:     retryCfg.Multiplier,
+	}
+	relayCtx, stopRelay := context.WithCancel(ctx)
+	relay := detection.NewRelay(detection.NewSQLiteOutboxRepository(db), manager, outboxCfg.PollInterval, outboxCfg.BatchSize, outboxCfg.Lease, retryPolicy)
+	if _, err := relay.Recover(ctx, cfg.Detection.Recovery.Lease); err != nil {
+		log.Fatalf("Failed to recover stale transactions: %v", err)
+	}
+	relay.RunInBackground(relayCtx)
 
-	rules := []detection.Rule{highVolRule, freqSmallRule, rapidTransRule}
-	detection.NewManager(transactionChannel, detectionRepo, rules...).RunInBackground()
+	publisher, err := newPublisher(relayCtx, cfg.Publisher, relay)
+	if err != nil {
+		log.Fatalf("Failed to create transaction publisher: %v", err)
+	}
+
+	// --- Handlers ---
+	txService := transaction.NewService(txRepo, publisher)
+	txHandler := transaction.NewHandler(txService)
+	detectionHandler := detection.NewHandler(detectionRepo)
+	adminHandler := detection.NewAdminHandler(deadLetterRepo, ruleStatsRepo, ruleVersionRepo, detection.NewBacktester(detectionRepo), manager, detection.NewTransferGraph(detectionRepo))
 
 	// --- Routes ---
 	e.GET("/", func(c echo.Context) error {
@@ -78,7 +134,99 @@ func main() {
 	apiGroup.POST("/transaction", txHandler.CreateTransaction)
 	apiGroup.GET("/transactions", detectionHandler.GetTransactions)
 
+	adminGroup := apiGroup.Group("/admin")
+	adminGroup.GET("/dead-letters", adminHandler.ListDeadLetters)
+	adminGroup.POST("/dead-letters/:id/replay", adminHandler.ReplayDeadLetter)
+	adminGroup.DELETE("/dead-letters/:id", adminHandler.DiscardDeadLetter)
+	adminGroup.GET("/rules/hit-rates", adminHandler.RuleHitRates)
+	adminGroup.POST("/rules/backtest", adminHandler.Backtest)
+	adminGroup.GET("/rules/versions/:version", adminHandler.RuleVersion)
+	adminGroup.POST("/rescan", adminHandler.Rescan)
+	adminGroup.GET("/users/:id/graph", adminHandler.UserGraph)
+
 	startServer(cfg, e)
+
+	// Stop feeding the workers first, then give queued detections a chance to finish. Anything left
+	// is released back to the outbox and picked up on the next start.
+	stopRelay()
+	relay.Wait()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.Detection.Workers.DrainTimeout)
+	defer cancelDrain()
+	if unprocessed, err := manager.Stop(drainCtx); err != nil {
+		log.Printf("Detection manager stopped with %d transactions left unprocessed: %v", unprocessed, err)
+	}
+}
+
+// watchRules rebuilds the Manager's rules whenever the rules section of the config file changes.
+func watchRules(current config.Rules, manager *detection.Manager, repo detection.Repository, versions detection.RuleVersionRepository) {
+	reloader := &rulesReloader{current: current, manager: manager, repo: repo, versions: versions}
+	config.Watch(reloader.reload)
+}
+
+// rulesReloader swaps the Manager's rules for the ones of a changed config, keeping the rules in use
+// when the new ones cannot be built or saved.
+type rulesReloader struct {
+	mu       sync.Mutex
+	current  config.Rules
+	manager  *detection.Manager
+	repo     detection.Repository
+	versions detection.RuleVersionRepository
+}
+
+// reload is called by config.Watch with the changed config, or the error it was rejected with.
+func (r *rulesReloader) reload(cfg config.Config, err error) {
+	if err != nil {
+		log.Printf("Config changed but was not applied, keeping rules version %s: %v", r.manager.RulesVersion(), err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	version := cfg.Detection.Rules.Version()
+	if version == r.manager.RulesVersion() {
+		return
+	}
+	rules, err := detection.BuildRules(cfg.Detection.Rules, r.repo)
+	if err != nil {
+		log.Printf("Config changed but was not applied, keeping rules version %s: %v", r.manager.RulesVersion(), err)
+		return
+	}
+	// Verdicts record the version, so it has to be saved before the first one is stored.
+	if err := r.versions.Save(context.Background(), version, cfg.Detection.Rules); err != nil {
+		log.Printf("Config changed but was not applied, keeping rules version %s: %v", r.manager.RulesVersion(), err)
+		return
+	}
+	log.Printf("Reloading detection rules. Before (version %s): %+v", r.manager.RulesVersion(), r.current)
+	log.Printf("Reloading detection rules. After (version %s): %+v", version, cfg.Detection.Rules)
+	r.manager.SetRules(version, rules, detection.NewRiskBands(cfg.Detection.Rules.Bands))
+	r.current = cfg.Detection.Rules
+}
+
+// newPublisher creates the configured publisher and starts feeding its output to the relay until ctx is cancelled.
+func newPublisher(ctx context.Context, cfg config.Publisher, relay *detection.Relay) (transaction.Publisher, error) {
+	switch cfg.Kind {
+	case "outbox":
+		return transaction.NewOutboxPublisher(), nil
+	case "file":
+		fileLog := transaction.NewFileLogPublisher(cfg.FilePath)
+		go fileLog.DrainEvery(ctx, cfg.DrainInterval, relay.ProcessBatch)
+		return fileLog, nil
+	case "queue":
+		var spill transaction.Publisher
+		if transaction.OverflowPolicy(cfg.Overflow) == transaction.OverflowSpill {
+			spillLog := transaction.NewFileLogPublisher(cfg.FilePath)
+			go spillLog.DrainEvery(ctx, cfg.DrainInterval, relay.ProcessBatch)
+			spill = spillLog
+		}
+		queue, err := transaction.NewQueuePublisher(cfg.QueueSize, transaction.OverflowPolicy(cfg.Overflow), cfg.BlockTimeout, spill)
+		if err != nil {
+			return nil, err
+		}
+		go relay.Consume(ctx, queue.Out())
+		return queue, nil
+	default:
+		return nil, fmt.Errorf("unknown publisher kind %q, must be one of [outbox, queue, file]", cfg.Kind)
+	}
 }
 
 func startServer(cfg config.Config, e *echo.Echo) {
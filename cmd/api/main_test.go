@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jasimvs/sample-go-svc/config"
+	detection "github.com/jasimvs/sample-go-svc/internal/detection"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRulesReloader tests that a changed config swaps the Manager's rules and saves their version, and
+// that a config rejected by config.Watch, or whose rules cannot be built, keeps the rules in use.
+func TestRulesReloader(t *testing.T) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?_foreign_keys=on", filepath.Join(t.TempDir(), "test_reload.db")))
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	repo, err := detection.NewSQLiteRepository(db)
+	require.NoError(t, err)
+	versions := detection.NewSQLiteRuleVersionRepository(db)
+	require.NoError(t, versions.Migrate(ctx))
+
+	initial, err := config.ParseRules("yaml", strings.NewReader(""))
+	require.NoError(t, err)
+	rules, err := detection.BuildRules(initial, repo)
+	require.NoError(t, err)
+	manager := detection.NewManager(repo)
+	manager.SetRules(initial.Version(), rules, detection.NewRiskBands(initial.Bands))
+	reloader := &rulesReloader{current: initial, manager: manager, repo: repo, versions: versions}
+
+	withRules := func(rules config.Rules) config.Config {
+		var cfg config.Config
+		cfg.Detection.Rules = rules
+		return cfg
+	}
+
+	t.Run("rejected by Watch", func(t *testing.T) {
+		reloader.reload(config.Config{}, errors.New("invalid configuration"))
+		assert.Equal(t, initial.Version(), manager.RulesVersion())
+	})
+
+	t.Run("rules cannot be built", func(t *testing.T) {
+		broken := initial
+		broken.Custom = []config.CustomRule{{Name: "Broken", Mode: config.ModeEnforce, Weight: 10, Expression: "amount >"}}
+		require.NoError(t, broken.Validate("detection.rules"), "Only BuildRules should reject it")
+		reloader.reload(withRules(broken), nil)
+		assert.Equal(t, initial.Version(), manager.RulesVersion())
+		_, err := versions.Get(ctx, broken.Version())
+		assert.ErrorIs(t, err, detection.ErrRuleVersionNotFound, "Rules that were not applied should not be saved")
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		changed := initial
+		changed.HighVolume.AmountThreshold *= 2
+		reloader.reload(withRules(changed), nil)
+		assert.Equal(t, changed.Version(), manager.RulesVersion())
+		assert.Equal(t, changed, reloader.current)
+		saved, err := versions.Get(ctx, changed.Version())
+		require.NoError(t, err)
+		assert.Equal(t, changed.HighVolume, saved.HighVolume)
+	})
+}
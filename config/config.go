@@ -1,10 +1,12 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
@@ -18,6 +20,24 @@ type Config struct {
 		MaxIdleConns    int           `mapstructure:"max_idle_conns"`
 		ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime"`
 	} `mapstructure:"database"`
+	Publisher Publisher `mapstructure:"publisher"`
+	Detection struct {
+		Outbox   Outbox `mapstructure:"outbox"`
+		Recovery struct {
+			Lease time.Duration `mapstructure:"lease"` // PENDING/ANALYZING transactions older than this are re-enqueued on boot
+		} `mapstructure:"recovery"`
+		Retry   Retry `mapstructure:"retry"`
+		Workers struct {
+			Count        int           `mapstructure:"count"`
+			QueueDepth   int           `mapstructure:"queue_depth"`   // Per worker; a full queue makes the relay wait
+			DrainTimeout time.Duration `mapstructure:"drain_timeout"` // How long shutdown waits for queued detections
+		} `mapstructure:"workers"`
+		WindowStore struct {
+			Enabled   bool          `mapstructure:"enabled"`
+			Retention time.Duration `mapstructure:"retention"` // Longer rule windows are answered by SQL
+		} `mapstructure:"window_store"`
+		Rules Rules `mapstructure:"rules"`
+	} `mapstructure:"detection"`
 }
 
 type Database struct {
@@ -27,6 +47,31 @@ type Database struct {
 	ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime"`
 }
 
+// Publisher selects how created transactions are handed to detection.
+type Publisher struct {
+	Kind          string        `mapstructure:"kind"` // outbox, queue or file
+	QueueSize     int           `mapstructure:"queue_size"`
+	Overflow      string        `mapstructure:"overflow"` // When the queue is full: block, spill or reject
+	BlockTimeout  time.Duration `mapstructure:"block_timeout"`
+	FilePath      string        `mapstructure:"file_path"` // File log for kind file, and spill file for overflow spill
+	DrainInterval time.Duration `mapstructure:"drain_interval"`
+}
+
+// Outbox controls how the detection relay polls the transaction outbox.
+type Outbox struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	BatchSize    int           `mapstructure:"batch_size"`
+	Lease        time.Duration `mapstructure:"lease"` // How long a claimed entry is hidden from other polls
+}
+
+// Retry controls how often a failed detection is retried before it is moved to the dead letter table.
+type Retry struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	Multiplier     float64       `mapstructure:"multiplier"`
+}
+
 // LoadConfig reads configuration from file or environment variables.
 func LoadConfig(path string) (config Config, err error) {
 	viper.AddConfigPath(path)
@@ -43,6 +88,26 @@ func LoadConfig(path string) (config Config, err error) {
 	viper.SetDefault("database.max_open_conns", 1)
 	viper.SetDefault("database.max_idle_conns", 1)
 	viper.SetDefault("database.conn_max_lifetime", "0s")
+	viper.SetDefault("publisher.kind", "outbox")
+	viper.SetDefault("publisher.queue_size", 1000)
+	viper.SetDefault("publisher.overflow", "reject")
+	viper.SetDefault("publisher.block_timeout", "2s")
+	viper.SetDefault("publisher.file_path", "./data/detection_queue.log")
+	viper.SetDefault("publisher.drain_interval", "1s")
+	viper.SetDefault("detection.outbox.poll_interval", "500ms")
+	viper.SetDefault("detection.outbox.batch_size", 50)
+	viper.SetDefault("detection.outbox.lease", "1m")
+	viper.SetDefault("detection.recovery.lease", "5m")
+	viper.SetDefault("detection.retry.max_attempts", 5)
+	viper.SetDefault("detection.retry.initial_backoff", "1s")
+	viper.SetDefault("detection.retry.max_backoff", "5m")
+	viper.SetDefault("detection.retry.multiplier", 2.0)
+	viper.SetDefault("detection.workers.count", 4)
+	viper.SetDefault("detection.workers.queue_depth", 100)
+	viper.SetDefault("detection.workers.drain_timeout", "10s")
+	viper.SetDefault("detection.window_store.enabled", true)
+	viper.SetDefault("detection.window_store.retention", "24h")
+	setRuleDefaults(viper.GetViper(), "detection.rules.")
 
 	err = viper.ReadInConfig()
 	if err != nil {
@@ -56,6 +121,64 @@ func LoadConfig(path string) (config Config, err error) {
 	if err != nil {
 		return Config{}, fmt.Errorf("unable to decode into struct: %w", err)
 	}
+	config.Detection.Rules.applyLegacy()
+
+	if err = config.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid configuration: %w", err)
+	}
 
 	return config, nil
 }
+
+// Watch calls onChange with the reloaded configuration whenever the config file changes. Invalid
+// configurations are passed along with their error, so the caller can keep the previous one.
+func Watch(onChange func(Config, error)) {
+	if viper.ConfigFileUsed() == "" {
+		fmt.Println("No config file in use, not watching for changes.")
+		return
+	}
+	viper.OnConfigChange(func(fsnotify.Event) {
+		var config Config
+		if err := viper.Unmarshal(&config); err != nil {
+			onChange(Config{}, fmt.Errorf("unable to decode into struct: %w", err))
+			return
+		}
+		config.Detection.Rules.applyLegacy()
+		if err := config.Validate(); err != nil {
+			onChange(Config{}, fmt.Errorf("invalid configuration: %w", err))
+			return
+		}
+		onChange(config, nil)
+	})
+	viper.WatchConfig()
+}
+
+// Validate checks the values that would otherwise only fail, or silently misbehave, once in use.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key string, format string, value any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s "+format, key, value))
+		}
+	}
+
+	o := c.Detection.Outbox
+	check(o.PollInterval > 0, "detection.outbox.poll_interval", "must be a positive duration, got %v", o.PollInterval)
+	check(o.BatchSize > 0, "detection.outbox.batch_size", "must be greater than 0, got %v", o.BatchSize)
+	check(o.Lease > 0, "detection.outbox.lease", "must be a positive duration, got %v", o.Lease)
+	w := c.Detection.Workers
+	check(w.Count > 0, "detection.workers.count", "must be greater than 0, got %v", w.Count)
+	check(w.QueueDepth >= 0, "detection.workers.queue_depth", "must not be negative, got %v", w.QueueDepth)
+	check(w.DrainTimeout > 0, "detection.workers.drain_timeout", "must be a positive duration, got %v", w.DrainTimeout)
+	// A zero multiplier or backoff retries in a hot loop, and no attempts dead letters every first failure.
+	r := c.Detection.Retry
+	check(r.MaxAttempts >= 1, "detection.retry.max_attempts", "must be at least 1, got %v", r.MaxAttempts)
+	check(r.InitialBackoff > 0, "detection.retry.initial_backoff", "must be a positive duration, got %v", r.InitialBackoff)
+	check(r.MaxBackoff >= r.InitialBackoff, "detection.retry.max_backoff", "must be at least detection.retry.initial_backoff, got %v", r.MaxBackoff)
+	check(r.Multiplier >= 1, "detection.retry.multiplier", "must be at least 1, got %v", r.Multiplier)
+	if ws := c.Detection.WindowStore; ws.Enabled {
+		check(ws.Retention > 0, "detection.window_store.retention", "must be a positive duration, got %v", ws.Retention)
+	}
+	errs = append(errs, c.Detection.Rules.Validate("detection.rules"))
+	return errors.Join(errs...)
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConfig_Validate tests that invalid detection settings are reported with their key.
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string // Empty when valid
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"zero poll interval", func(c *Config) { c.Detection.Outbox.PollInterval = 0 }, "detection.outbox.poll_interval"},
+		{"empty batch", func(c *Config) { c.Detection.Outbox.BatchSize = 0 }, "detection.outbox.batch_size"},
+		{"zero outbox lease", func(c *Config) { c.Detection.Outbox.Lease = 0 }, "detection.outbox.lease"},
+		{"no workers", func(c *Config) { c.Detection.Workers.Count = 0 }, "detection.workers.count"},
+		{"unbuffered worker queues", func(c *Config) { c.Detection.Workers.QueueDepth = 0 }, ""},
+		{"negative queue depth", func(c *Config) { c.Detection.Workers.QueueDepth = -1 }, "detection.workers.queue_depth"},
+		{"zero drain timeout", func(c *Config) { c.Detection.Workers.DrainTimeout = 0 }, "detection.workers.drain_timeout"},
+		{"no attempts", func(c *Config) { c.Detection.Retry.MaxAttempts = 0 }, "detection.retry.max_attempts"},
+		{"zero initial backoff", func(c *Config) { c.Detection.Retry.InitialBackoff = 0 }, "detection.retry.initial_backoff"},
+		{"max below initial backoff", func(c *Config) { c.Detection.Retry.MaxBackoff = time.Millisecond }, "detection.retry.max_backoff"},
+		{"shrinking backoff", func(c *Config) { c.Detection.Retry.Multiplier = 0.5 }, "detection.retry.multiplier"},
+		{"constant backoff", func(c *Config) { c.Detection.Retry.Multiplier = 1 }, ""},
+		{"window store without retention", func(c *Config) {
+			c.Detection.WindowStore.Enabled, c.Detection.WindowStore.Retention = true, 0
+		}, "detection.window_store.retention"},
+		{"invalid rules", func(c *Config) { c.Detection.Rules.HighVolume.Weight = 0 }, "detection.rules.high_volume.weight"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			tt.change(&cfg)
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr+" ")
+		})
+	}
+}
+
+// validConfig has the default detection settings, for the tests to break one value at a time.
+func validConfig(t *testing.T) Config {
+	t.Helper()
+	var cfg Config
+	cfg.Detection.Outbox = Outbox{PollInterval: 500 * time.Millisecond, BatchSize: 50, Lease: time.Minute}
+	cfg.Detection.Workers.Count, cfg.Detection.Workers.QueueDepth, cfg.Detection.Workers.DrainTimeout = 4, 100, 10*time.Second
+	cfg.Detection.Retry = Retry{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 5 * time.Minute, Multiplier: 2}
+	cfg.Detection.Rules = defaultRules(t)
+	return cfg
+}
@@ -0,0 +1,404 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Rules configures the detection rules. Every rule has a mode, see ModeEnforce. A matching enforced
+// rule adds its weight to the transaction's 0-100 risk score, and Bands decide what gets flagged.
+type Rules struct {
+	Bands                     RiskBands                 `mapstructure:"bands"`
+	HighVolume                HighVolume                `mapstructure:"high_volume"`
+	FrequentSmallTransactions FrequentSmallTransactions `mapstructure:"frequent_small_transactions"`
+	RapidTransfers            RapidTransfers            `mapstructure:"rapid_transfers"`
+	Structuring               Structuring               `mapstructure:"structuring"`
+	VelocityAmount            VelocityAmount            `mapstructure:"velocity_amount"`
+	Anomaly                   Anomaly                   `mapstructure:"anomaly"`
+	Dormancy                  Dormancy                  `mapstructure:"dormancy"`
+	NetworkFan                NetworkFan                `mapstructure:"network_fan"`
+	CircularFlow              CircularFlow              `mapstructure:"circular_flow"`
+	Custom                    []CustomRule              `mapstructure:"custom"`
+}
+
+// Rule modes. Shadow rules are evaluated and their hits recorded, but they do not affect the risk
+// score, so a new rule can be observed before it is enforced.
+const (
+	ModeEnforce  = "enforce"
+	ModeShadow   = "shadow"
+	ModeDisabled = "disabled"
+)
+
+// BuiltInRuleNames are the names the built-in rules flag transactions with, which custom rules cannot use.
+var BuiltInRuleNames = []string{
+	"HighVolumeTransaction", "FrequentSmallTransactions", "RapidTransfers", "Structuring", "VelocityAmount",
+	"Anomaly", "Dormancy", "NetworkFan", "CircularFlow",
+}
+
+// RiskBands splits the risk score into low, medium and high. Transactions in the Flag band or above
+// are flagged as suspicious.
+type RiskBands struct {
+	Medium float64 `mapstructure:"medium"` // Lowest score in the medium band
+	High   float64 `mapstructure:"high"`   // Lowest score in the high band
+	Flag   string  `mapstructure:"flag"`   // MEDIUM or HIGH
+}
+
+// HighVolume flags any transaction above AmountThreshold.
+type HighVolume struct {
+	Mode            string  `mapstructure:"mode"`
+	Enabled         *bool   `mapstructure:"enabled" json:"-"` // Replaced by Mode, see applyLegacy
+	Weight          float64 `mapstructure:"weight"`
+	AmountThreshold float64 `mapstructure:"amount_threshold"`
+}
+
+// FrequentSmallTransactions flags more than MaxCount transactions below ThresholdAmount within Window.
+type FrequentSmallTransactions struct {
+	Mode            string        `mapstructure:"mode"`
+	Enabled         *bool         `mapstructure:"enabled" json:"-"` // Replaced by Mode, see applyLegacy
+	Weight          float64       `mapstructure:"weight"`
+	MaxCount        int           `mapstructure:"max_count"`
+	ThresholdAmount float64       `mapstructure:"threshold_amount"`
+	Window          time.Duration `mapstructure:"window"`
+}
+
+// RapidTransfers flags MinConsecutive or more transfers within Window. With Match consecutive they
+// must follow each other without another transaction in between; with any they only have to be in
+// the window.
+type RapidTransfers struct {
+	Mode           string        `mapstructure:"mode"`
+	Enabled        *bool         `mapstructure:"enabled" json:"-"` // Replaced by Mode, see applyLegacy
+	Weight         float64       `mapstructure:"weight"`
+	MinConsecutive int           `mapstructure:"min_consecutive"`
+	Window         time.Duration `mapstructure:"window"`
+	Match          string        `mapstructure:"match"` // consecutive or any
+}
+
+// Structuring flags amounts split up to stay below a reporting threshold: a transaction just below
+// its type's threshold, within BandPercent of it, that together with the user's other such
+// transactions of that type within Window adds up to more than the threshold.
+type Structuring struct {
+	Mode        string            `mapstructure:"mode"`
+	Weight      float64           `mapstructure:"weight"`
+	Window      time.Duration     `mapstructure:"window"`
+	BandPercent float64           `mapstructure:"band_percent"`
+	Types       []StructuringType `mapstructure:"types"` // Types not listed are not checked
+}
+
+// StructuringType is the reporting threshold of one transaction type. A zero BandPercent means
+// Structuring.BandPercent, since list entries do not get defaults.
+type StructuringType struct {
+	Type        string  `mapstructure:"type"`
+	Threshold   float64 `mapstructure:"threshold"`
+	BandPercent float64 `mapstructure:"band_percent"`
+}
+
+// VelocityAmount flags a transaction of one of Types when the user's transactions of those types add
+// up to more than a limit's MaxAmount within its Window, for any of Limits.
+type VelocityAmount struct {
+	Mode   string          `mapstructure:"mode"`
+	Weight float64         `mapstructure:"weight"`
+	Types  []string        `mapstructure:"types"`
+	Limits []VelocityLimit `mapstructure:"limits"`
+}
+
+type VelocityLimit struct {
+	Window    time.Duration `mapstructure:"window"`
+	MaxAmount float64       `mapstructure:"max_amount"`
+}
+
+// Anomaly flags a transaction that is unusual for the user, compared with their own transactions over
+// Lookback. Users with fewer than MinHistory transactions are not checked. A zero limit turns its
+// check off.
+type Anomaly struct {
+	Mode               string        `mapstructure:"mode"`
+	Weight             float64       `mapstructure:"weight"`
+	Lookback           time.Duration `mapstructure:"lookback"`
+	MinHistory         int           `mapstructure:"min_history"`
+	MaxZScore          float64       `mapstructure:"max_z_score"`           // Of the amount, against the same type
+	MaxPercentile      float64       `mapstructure:"max_percentile"`        // Of the amount, among the same type
+	MinHourShare       float64       `mapstructure:"min_hour_share"`        // Percent of transactions in the same UTC hour
+	MaxFrequencyZScore float64       `mapstructure:"max_frequency_z_score"` // Of the last 24h's count, against the daily counts
+}
+
+// Dormancy flags an account without transactions for Period that then moves at least MinAmount in
+// one transaction, or at least VelocityAmount within VelocityWindow. A zero amount turns its check off.
+type Dormancy struct {
+	Mode           string        `mapstructure:"mode"`
+	Weight         float64       `mapstructure:"weight"`
+	Period         time.Duration `mapstructure:"period"`
+	MinAmount      float64       `mapstructure:"min_amount"`
+	VelocityWindow time.Duration `mapstructure:"velocity_window"`
+	VelocityAmount float64       `mapstructure:"velocity_amount"`
+}
+
+// NetworkFan flags transfers within Window from a user to more than MaxRecipients new counterparties
+// (fan-out), or from more than MaxSenders users to one counterparty (fan-in). Recipients the user sent
+// to within History before the window are not new. A zero limit turns its direction off.
+type NetworkFan struct {
+	Mode          string        `mapstructure:"mode"`
+	Weight        float64       `mapstructure:"weight"`
+	Window        time.Duration `mapstructure:"window"`
+	History       time.Duration `mapstructure:"history"`
+	MaxRecipients int           `mapstructure:"max_recipients"`
+	MaxSenders    int           `mapstructure:"max_senders"`
+}
+
+// CircularFlow flags a transfer that brings money back to where it came from: it closes a circle of
+// at most MaxHops transfers, each after the one before, all within Window.
+type CircularFlow struct {
+	Mode    string        `mapstructure:"mode"`
+	Weight  float64       `mapstructure:"weight"`
+	Window  time.Duration `mapstructure:"window"`
+	MaxHops int           `mapstructure:"max_hops"`
+}
+
+// CustomRule is a rule written in the detection expression language, e.g.
+// `sum(24h, type == "withdrawal") > 5000`. An empty Mode means enforce, since list entries do not get
+// defaults.
+type CustomRule struct {
+	Name       string  `mapstructure:"name"`
+	Mode       string  `mapstructure:"mode"`
+	Enabled    *bool   `mapstructure:"enabled" json:"-"` // Replaced by Mode, see applyLegacy
+	Weight     float64 `mapstructure:"weight"`
+	Expression string  `mapstructure:"expression"`
+}
+
+func (c CustomRule) RuleMode() string {
+	if c.Mode == "" {
+		return ModeEnforce
+	}
+	return c.Mode
+}
+
+// ParseRules reads a rules section on its own, e.g. a candidate rule set to backtest, in the given
+// format (yaml or json). Settings it leaves out get the same defaults as in config.yaml.
+func ParseRules(format string, in io.Reader) (Rules, error) {
+	v := viper.New()
+	v.SetConfigType(format)
+	setRuleDefaults(v, "")
+	if err := v.ReadConfig(in); err != nil {
+		return Rules{}, fmt.Errorf("error reading rules: %w", err)
+	}
+
+	var rules Rules
+	if err := v.Unmarshal(&rules); err != nil {
+		return Rules{}, fmt.Errorf("unable to decode rules: %w", err)
+	}
+	rules.applyLegacy()
+	if err := rules.Validate("rules"); err != nil {
+		return Rules{}, fmt.Errorf("invalid rules: %w", err)
+	}
+	return rules, nil
+}
+
+// applyLegacy honours the enabled flag that rules had before modes: enabled: false disables the rule
+// whatever its mode, which otherwise defaults to enforce and would turn it back on.
+func (r *Rules) applyLegacy() {
+	disable := func(enabled *bool, mode *string) {
+		if enabled != nil && !*enabled {
+			*mode = ModeDisabled
+		}
+	}
+	disable(r.HighVolume.Enabled, &r.HighVolume.Mode)
+	disable(r.FrequentSmallTransactions.Enabled, &r.FrequentSmallTransactions.Mode)
+	disable(r.RapidTransfers.Enabled, &r.RapidTransfers.Mode)
+	for i := range r.Custom {
+		disable(r.Custom[i].Enabled, &r.Custom[i].Mode)
+	}
+}
+
+// setRuleDefaults sets the default of every rule setting under prefix. The rules added after the first
+// three default to shadow, so upgrading does not start flagging with a rule nobody has measured yet.
+func setRuleDefaults(v *viper.Viper, prefix string) {
+	v.SetDefault(prefix+"bands.medium", 40.0)
+	v.SetDefault(prefix+"bands.high", 70.0)
+	v.SetDefault(prefix+"bands.flag", "MEDIUM")
+	v.SetDefault(prefix+"high_volume.mode", "enforce")
+	v.SetDefault(prefix+"high_volume.weight", 70.0)
+	v.SetDefault(prefix+"high_volume.amount_threshold", 10000.0)
+	v.SetDefault(prefix+"frequent_small_transactions.mode", "enforce")
+	v.SetDefault(prefix+"frequent_small_transactions.weight", 50.0)
+	v.SetDefault(prefix+"frequent_small_transactions.max_count", 10)
+	v.SetDefault(prefix+"frequent_small_transactions.threshold_amount", 100.0)
+	v.SetDefault(prefix+"frequent_small_transactions.window", "1h")
+	v.SetDefault(prefix+"rapid_transfers.mode", "enforce")
+	v.SetDefault(prefix+"rapid_transfers.weight", 60.0)
+	v.SetDefault(prefix+"rapid_transfers.min_consecutive", 3)
+	v.SetDefault(prefix+"rapid_transfers.window", "5m")
+	v.SetDefault(prefix+"rapid_transfers.match", "consecutive")
+	v.SetDefault(prefix+"structuring.mode", "shadow")
+	v.SetDefault(prefix+"structuring.weight", 60.0)
+	v.SetDefault(prefix+"structuring.window", "72h")
+	v.SetDefault(prefix+"structuring.band_percent", 10.0)
+	// A list rather than a map keyed by type, so configured types replace the defaults instead of
+	// being merged with them.
+	v.SetDefault(prefix+"structuring.types", []map[string]any{
+		{"type": "deposit", "threshold": 10000.0},
+		{"type": "withdrawal", "threshold": 10000.0},
+	})
+	v.SetDefault(prefix+"velocity_amount.mode", "shadow")
+	v.SetDefault(prefix+"velocity_amount.weight", 50.0)
+	v.SetDefault(prefix+"velocity_amount.types", []string{"withdrawal", "transfer"})
+	v.SetDefault(prefix+"velocity_amount.limits", []map[string]any{
+		{"window": "1h", "max_amount": 10000.0},
+		{"window": "24h", "max_amount": 25000.0},
+		{"window": "168h", "max_amount": 50000.0},
+	})
+	// Shadow until its hit rate has been looked at, since what it flags depends on each user's history.
+	v.SetDefault(prefix+"anomaly.mode", "shadow")
+	v.SetDefault(prefix+"anomaly.weight", 40.0)
+	v.SetDefault(prefix+"anomaly.lookback", "720h")
+	v.SetDefault(prefix+"anomaly.min_history", 20)
+	v.SetDefault(prefix+"anomaly.max_z_score", 4.0)
+	v.SetDefault(prefix+"anomaly.max_percentile", 0.0)
+	v.SetDefault(prefix+"anomaly.min_hour_share", 0.0)
+	v.SetDefault(prefix+"anomaly.max_frequency_z_score", 4.0)
+	v.SetDefault(prefix+"dormancy.mode", "shadow")
+	v.SetDefault(prefix+"dormancy.weight", 50.0)
+	v.SetDefault(prefix+"dormancy.period", "2160h")
+	v.SetDefault(prefix+"dormancy.min_amount", 5000.0)
+	v.SetDefault(prefix+"dormancy.velocity_window", "24h")
+	v.SetDefault(prefix+"dormancy.velocity_amount", 10000.0)
+	v.SetDefault(prefix+"network_fan.mode", "shadow")
+	v.SetDefault(prefix+"network_fan.weight", 60.0)
+	v.SetDefault(prefix+"network_fan.window", "24h")
+	v.SetDefault(prefix+"network_fan.history", "720h")
+	v.SetDefault(prefix+"network_fan.max_recipients", 5)
+	v.SetDefault(prefix+"network_fan.max_senders", 5)
+	v.SetDefault(prefix+"circular_flow.mode", "shadow")
+	v.SetDefault(prefix+"circular_flow.weight", 70.0)
+	v.SetDefault(prefix+"circular_flow.window", "72h")
+	v.SetDefault(prefix+"circular_flow.max_hops", 4)
+}
+
+// Validate reports every invalid value of the rules that are not disabled, prefixing each with its
+// config key.
+func (r Rules) Validate(prefix string) error {
+	var errs []error
+	check := func(ok bool, key string, format string, value any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s.%s "+format, prefix, key, value))
+		}
+	}
+
+	b := r.Bands
+	check(b.Medium > 0, "bands.medium", "must be greater than 0, got %v", b.Medium)
+	check(b.High > b.Medium && b.High <= 100, "bands.high", "must be above bands.medium and at most 100, got %v", b.High)
+	check(b.Flag == "MEDIUM" || b.Flag == "HIGH", "bands.flag", "must be MEDIUM or HIGH, got %q", b.Flag)
+	checkWeight := func(key string, weight float64) {
+		check(weight > 0 && weight <= 100, key+".weight", "must be greater than 0 and at most 100, got %v", weight)
+	}
+	// active checks the mode and reports whether the rest of the rule needs checking.
+	active := func(key, mode string) bool {
+		check(mode == ModeEnforce || mode == ModeShadow || mode == ModeDisabled, key+".mode", "must be enforce, shadow or disabled, got %q", mode)
+		return mode != ModeDisabled
+	}
+
+	if hv := r.HighVolume; active("high_volume", hv.Mode) {
+		checkWeight("high_volume", hv.Weight)
+		check(hv.AmountThreshold > 0, "high_volume.amount_threshold", "must be greater than 0, got %v", hv.AmountThreshold)
+	}
+	if fs := r.FrequentSmallTransactions; active("frequent_small_transactions", fs.Mode) {
+		checkWeight("frequent_small_transactions", fs.Weight)
+		check(fs.MaxCount > 0, "frequent_small_transactions.max_count", "must be greater than 0, got %v", fs.MaxCount)
+		check(fs.ThresholdAmount > 0, "frequent_small_transactions.threshold_amount", "must be greater than 0, got %v", fs.ThresholdAmount)
+		check(fs.Window > 0, "frequent_small_transactions.window", "must be a positive duration, got %v", fs.Window)
+	}
+	if rt := r.RapidTransfers; active("rapid_transfers", rt.Mode) {
+		checkWeight("rapid_transfers", rt.Weight)
+		check(rt.MinConsecutive > 1, "rapid_transfers.min_consecutive", "must be at least 2, got %v", rt.MinConsecutive)
+		check(rt.Window > 0, "rapid_transfers.window", "must be a positive duration, got %v", rt.Window)
+		check(rt.Match == "consecutive" || rt.Match == "any", "rapid_transfers.match", "must be consecutive or any, got %q", rt.Match)
+	}
+	if st := r.Structuring; active("structuring", st.Mode) {
+		checkWeight("structuring", st.Weight)
+		check(st.Window > 0, "structuring.window", "must be a positive duration, got %v", st.Window)
+		check(st.BandPercent > 0 && st.BandPercent < 100, "structuring.band_percent", "must be between 0 and 100, got %v", st.BandPercent)
+		check(len(st.Types) > 0, "structuring.types", "must list at least one transaction type, got %d", len(st.Types))
+		types := make(map[string]bool)
+		for i, t := range st.Types {
+			key := fmt.Sprintf("structuring.types[%d]", i)
+			check(t.Type != "" && !types[t.Type], key+".type", "must be set and unique, got %q", t.Type)
+			check(t.Threshold > 0, key+".threshold", "must be greater than 0, got %v", t.Threshold)
+			check(t.BandPercent >= 0 && t.BandPercent < 100, key+".band_percent", "must be between 0 and 100, got %v", t.BandPercent)
+			types[t.Type] = true
+		}
+	}
+	if va := r.VelocityAmount; active("velocity_amount", va.Mode) {
+		checkWeight("velocity_amount", va.Weight)
+		check(len(va.Types) > 0, "velocity_amount.types", "must list at least one transaction type, got %d", len(va.Types))
+		check(len(va.Limits) > 0, "velocity_amount.limits", "must have at least one limit, got %d", len(va.Limits))
+		windows := make(map[time.Duration]bool)
+		for i, limit := range va.Limits {
+			key := fmt.Sprintf("velocity_amount.limits[%d]", i)
+			check(limit.Window > 0 && !windows[limit.Window], key+".window", "must be a positive duration and unique, got %v", limit.Window)
+			check(limit.MaxAmount > 0, key+".max_amount", "must be greater than 0, got %v", limit.MaxAmount)
+			windows[limit.Window] = true
+		}
+	}
+	if an := r.Anomaly; active("anomaly", an.Mode) {
+		checkWeight("anomaly", an.Weight)
+		check(an.Lookback >= 24*time.Hour, "anomaly.lookback", "must be at least 24h, got %v", an.Lookback)
+		check(an.MinHistory >= 2, "anomaly.min_history", "must be at least 2, got %v", an.MinHistory)
+		check(an.MaxZScore >= 0, "anomaly.max_z_score", "must not be negative, got %v", an.MaxZScore)
+		check(an.MaxPercentile >= 0 && an.MaxPercentile < 100, "anomaly.max_percentile", "must be between 0 and 100, got %v", an.MaxPercentile)
+		check(an.MinHourShare >= 0 && an.MinHourShare <= 100, "anomaly.min_hour_share", "must be between 0 and 100, got %v", an.MinHourShare)
+		check(an.MaxFrequencyZScore >= 0, "anomaly.max_frequency_z_score", "must not be negative, got %v", an.MaxFrequencyZScore)
+		check(an.MaxZScore > 0 || an.MaxPercentile > 0 || an.MinHourShare > 0 || an.MaxFrequencyZScore > 0, "anomaly.max_z_score", "or another limit must be set, got %v", an.MaxZScore)
+	}
+	if do := r.Dormancy; active("dormancy", do.Mode) {
+		checkWeight("dormancy", do.Weight)
+		check(do.Period > 0, "dormancy.period", "must be a positive duration, got %v", do.Period)
+		check(do.VelocityWindow > 0, "dormancy.velocity_window", "must be a positive duration, got %v", do.VelocityWindow)
+		check(do.MinAmount >= 0, "dormancy.min_amount", "must not be negative, got %v", do.MinAmount)
+		check(do.VelocityAmount >= 0, "dormancy.velocity_amount", "must not be negative, got %v", do.VelocityAmount)
+		check(do.MinAmount > 0 || do.VelocityAmount > 0, "dormancy.min_amount", "or dormancy.velocity_amount must be set, got %v", do.MinAmount)
+	}
+	if nf := r.NetworkFan; active("network_fan", nf.Mode) {
+		checkWeight("network_fan", nf.Weight)
+		check(nf.Window > 0, "network_fan.window", "must be a positive duration, got %v", nf.Window)
+		check(nf.History >= 0, "network_fan.history", "must not be negative, got %v", nf.History)
+		check(nf.MaxRecipients >= 0, "network_fan.max_recipients", "must not be negative, got %v", nf.MaxRecipients)
+		check(nf.MaxSenders >= 0, "network_fan.max_senders", "must not be negative, got %v", nf.MaxSenders)
+		check(nf.MaxRecipients > 0 || nf.MaxSenders > 0, "network_fan.max_recipients", "or network_fan.max_senders must be set, got %v", nf.MaxRecipients)
+	}
+	if cf := r.CircularFlow; active("circular_flow", cf.Mode) {
+		checkWeight("circular_flow", cf.Weight)
+		check(cf.Window > 0, "circular_flow.window", "must be a positive duration, got %v", cf.Window)
+		// Every hop is a query per visited user, so the search is kept short.
+		check(cf.MaxHops >= 2 && cf.MaxHops <= 6, "circular_flow.max_hops", "must be between 2 and 6, got %v", cf.MaxHops)
+	}
+	// Expressions are compiled, and their syntax checked, by detection.BuildRules.
+	names := make(map[string]bool)
+	for i, custom := range r.Custom {
+		key := fmt.Sprintf("custom[%d]", i)
+		check(custom.Name != "", key+".name", "must be set, got %q", custom.Name)
+		check(custom.Name == "" || !names[custom.Name], key+".name", "must be unique, %q is used more than once", custom.Name)
+		check(!slices.Contains(BuiltInRuleNames, custom.Name), key+".name", "must not be the name of a built-in rule, got %q", custom.Name)
+		check(custom.Expression != "", key+".expression", "must be set, got %q", custom.Expression)
+		if active(key, custom.RuleMode()) {
+			checkWeight(key, custom.Weight)
+		}
+		names[custom.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// Version identifies this rule configuration; it changes whenever any rule setting changes.
+func (r Rules) Version() string {
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		// Rules only holds plain values, so this cannot happen.
+		panic(fmt.Sprintf("failed to encode rules config: %v", err))
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])[:12]
+}
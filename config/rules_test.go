@@ -0,0 +1,97 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseRules_LegacyEnabled tests that rules turned off with the enabled flag from before modes stay off.
+func TestParseRules_LegacyEnabled(t *testing.T) {
+	rules, err := ParseRules("yaml", strings.NewReader(`
+high_volume:
+  enabled: false
+frequent_small_transactions:
+  enabled: true
+rapid_transfers:
+  enabled: false
+  mode: shadow
+custom:
+  - name: Legacy
+    enabled: false
+    weight: 10
+    expression: amount > 1
+`))
+	require.NoError(t, err)
+	assert.Equal(t, ModeDisabled, rules.HighVolume.Mode)
+	assert.Equal(t, ModeEnforce, rules.FrequentSmallTransactions.Mode)
+	assert.Equal(t, ModeDisabled, rules.RapidTransfers.Mode)
+	assert.Equal(t, ModeDisabled, rules.Custom[0].RuleMode())
+}
+
+// TestRules_Validate tests that invalid values are reported with their key, and that disabled rules are not checked.
+func TestRules_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(r *Rules)
+		wantErr string // Empty when valid
+	}{
+		{"valid", func(r *Rules) {}, ""},
+		{"zero threshold", func(r *Rules) { r.HighVolume.AmountThreshold = 0 }, "rules.high_volume.amount_threshold"},
+		{"zero window", func(r *Rules) { r.FrequentSmallTransactions.Window = 0 }, "rules.frequent_small_transactions.window"},
+		{"single transfer", func(r *Rules) { r.RapidTransfers.MinConsecutive = 1 }, "rules.rapid_transfers.min_consecutive"},
+		{"disabled rule not checked", func(r *Rules) { r.HighVolume.Mode, r.HighVolume.AmountThreshold = ModeDisabled, 0 }, ""},
+		{"weight zero", func(r *Rules) { r.HighVolume.Weight = 0 }, "rules.high_volume.weight"},
+		{"weight above 100", func(r *Rules) { r.RapidTransfers.Weight = 101 }, "rules.rapid_transfers.weight"},
+		{"bands out of order", func(r *Rules) { r.Bands.High = r.Bands.Medium }, "rules.bands.high"},
+		{"band above 100", func(r *Rules) { r.Bands.High = 101 }, "rules.bands.high"},
+		{"unknown flag band", func(r *Rules) { r.Bands.Flag = "LOW" }, "rules.bands.flag"},
+		{"unknown mode", func(r *Rules) { r.HighVolume.Mode = "on" }, "rules.high_volume.mode"},
+		{"shadow rule checked", func(r *Rules) { r.RapidTransfers.Mode, r.RapidTransfers.Weight = ModeShadow, 0 }, "rules.rapid_transfers.weight"},
+		{"unknown match", func(r *Rules) { r.RapidTransfers.Match = "sometimes" }, "rules.rapid_transfers.match"},
+		{"duplicate structuring type", func(r *Rules) {
+			r.Structuring.Types = append(r.Structuring.Types, r.Structuring.Types[0])
+		}, "rules.structuring.types[" + strconv.Itoa(len(defaultRules(t).Structuring.Types)) + "].type"},
+		{"duplicate velocity window", func(r *Rules) {
+			r.VelocityAmount.Limits = append(r.VelocityAmount.Limits, r.VelocityAmount.Limits[0])
+		}, "rules.velocity_amount.limits[" + strconv.Itoa(len(defaultRules(t).VelocityAmount.Limits)) + "].window"},
+		{"anomaly without limits", func(r *Rules) {
+			r.Anomaly.MaxZScore, r.Anomaly.MaxPercentile, r.Anomaly.MinHourShare, r.Anomaly.MaxFrequencyZScore = 0, 0, 0, 0
+		}, "rules.anomaly.max_z_score"},
+		{"dormancy without amounts", func(r *Rules) { r.Dormancy.MinAmount, r.Dormancy.VelocityAmount = 0, 0 }, "rules.dormancy.min_amount"},
+		{"network fan without limits", func(r *Rules) { r.NetworkFan.MaxRecipients, r.NetworkFan.MaxSenders = 0, 0 }, "rules.network_fan.max_recipients"},
+		{"circular flow of one hop", func(r *Rules) { r.CircularFlow.MaxHops = 1 }, "rules.circular_flow.max_hops"},
+		{"custom without name", func(r *Rules) { r.Custom = []CustomRule{{Weight: 10, Expression: "amount > 1"}} }, "rules.custom[0].name"},
+		{"duplicate custom names", func(r *Rules) {
+			r.Custom = []CustomRule{{Name: "A", Weight: 10, Expression: "amount > 1"}, {Name: "A", Weight: 10, Expression: "amount > 2"}}
+		}, "rules.custom[1].name"},
+		{"custom named like a built-in rule", func(r *Rules) {
+			r.Custom = []CustomRule{{Name: "RapidTransfers", Weight: 10, Expression: "amount > 1"}}
+		}, "rules.custom[0].name"},
+		{"custom without expression", func(r *Rules) { r.Custom = []CustomRule{{Name: "A", Weight: 10}} }, "rules.custom[0].expression"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := defaultRules(t)
+			tt.change(&rules)
+			err := rules.Validate("rules")
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr+" ")
+		})
+	}
+}
+
+// defaultRules is the rules section with every setting left to its default.
+func defaultRules(t *testing.T) Rules {
+	t.Helper()
+	rules, err := ParseRules("yaml", strings.NewReader(""))
+	require.NoError(t, err)
+	return rules
+}
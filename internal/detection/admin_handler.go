@@ -0,0 +1,236 @@
+package detection
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/config"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultDeadLetterLimit = 100
+	defaultHitRateWindow   = 24 * time.Hour
+	defaultGraphHops       = 2
+	maxGraphHops           = 4
+	defaultGraphWindow     = 7 * 24 * time.Hour
+	maxRescanRange         = 31 * 24 * time.Hour
+)
+
+// AdminHandler serves operational endpoints. Ideally these sit behind an admin-only auth check.
+type AdminHandler struct {
+	deadLetters  DeadLetterRepository
+	ruleStats    RuleStatsRepository
+	ruleVersions RuleVersionRepository
+	backtester   *Backtester
+	manager      *Manager
+	graph        *TransferGraph
+}
+
+func NewAdminHandler(deadLetters DeadLetterRepository, ruleStats RuleStatsRepository, ruleVersions RuleVersionRepository, backtester *Backtester, manager *Manager, graph *TransferGraph) *AdminHandler {
+	return &AdminHandler{deadLetters: deadLetters, ruleStats: ruleStats, ruleVersions: ruleVersions, backtester: backtester, manager: manager, graph: graph}
+}
+
+func (h *AdminHandler) ListDeadLetters(c echo.Context) error {
+	limit := defaultDeadLetterLimit
+	if limitParam := c.QueryParam("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed <= 0 {
+			log.Printf("Handler: Invalid value for 'limit' query parameter: %q", limitParam)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid value for query parameter 'limit': %s", limitParam))
+		}
+		limit = parsed
+	}
+
+	deadLetters, err := h.deadLetters.List(c.Request().Context(), limit)
+	if err != nil {
+		log.Printf("Handler: Error listing dead letters: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to list dead letters")
+	}
+	return c.JSON(http.StatusOK, deadLetters)
+}
+
+func (h *AdminHandler) ReplayDeadLetter(c echo.Context) error {
+	id, err := deadLetterID(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.deadLetters.Replay(c.Request().Context(), id); err != nil {
+		return deadLetterError("replay", id, err)
+	}
+	log.Printf("Handler: Dead letter %d replayed", id)
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (h *AdminHandler) DiscardDeadLetter(c echo.Context) error {
+	id, err := deadLetterID(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.deadLetters.Discard(c.Request().Context(), id); err != nil {
+		return deadLetterError("discard", id, err)
+	}
+	log.Printf("Handler: Dead letter %d discarded", id)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RuleHitRates compares the hit rates of shadow and enforced rules over the trailing window, 24h by default.
+func (h *AdminHandler) RuleHitRates(c echo.Context) error {
+	window := defaultHitRateWindow
+	if windowParam := c.QueryParam("window"); windowParam != "" {
+		parsed, err := time.ParseDuration(windowParam)
+		if err != nil || parsed <= 0 {
+			log.Printf("Handler: Invalid value for 'window' query parameter: %q", windowParam)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid value for query parameter 'window': %s", windowParam))
+		}
+		window = parsed
+	}
+
+	hitRates, err := h.ruleStats.HitRates(c.Request().Context(), time.Now().UTC().Add(-window))
+	if err != nil {
+		log.Printf("Handler: Error computing rule hit rates: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to compute rule hit rates")
+	}
+	return c.JSON(http.StatusOK, hitRates)
+}
+
+// Backtest replays the transactions between the from and to query parameters through the candidate
+// rules in the request body, a rules section in JSON, or YAML when the Content-Type says so.
+func (h *AdminHandler) Backtest(c echo.Context) error {
+	var bounds [2]time.Time
+	for i, name := range []string{"from", "to"} {
+		parsed, err := ParseBacktestTime(c.QueryParam(name))
+		if err != nil {
+			log.Printf("Handler: Invalid value for '%s' query parameter: %v", name, err)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid value for query parameter '%s': %v", name, err))
+		}
+		bounds[i] = parsed
+	}
+	from, to := bounds[0], bounds[1]
+	if !from.Before(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Query parameter 'from' must be before 'to'")
+	}
+
+	format := "json"
+	if strings.Contains(c.Request().Header.Get(echo.HeaderContentType), "yaml") {
+		format = "yaml"
+	}
+	rules, err := config.ParseRules(format, c.Request().Body)
+	if err != nil {
+		log.Printf("Handler: Invalid candidate rules: %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid candidate rules: %v", err))
+	}
+
+	report, err := h.backtester.Run(c.Request().Context(), rules, from, to)
+	if errors.Is(err, ErrInvalidRules) {
+		log.Printf("Handler: Invalid candidate rules: %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid candidate rules: %v", err))
+	}
+	if err != nil {
+		log.Printf("Handler: Error running backtest: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to run backtest")
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// Rescan re-evaluates the analyzed transactions selected by the RescanFilter in the request body with
+// the current rules. It runs within the request, so the filter must have a date range of at most
+// maxRescanRange; larger rescans are done with `app rescan`.
+func (h *AdminHandler) Rescan(c echo.Context) error {
+	var filter RescanFilter
+	if err := c.Bind(&filter); err != nil {
+		log.Printf("Handler: Invalid rescan filter: %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid rescan filter")
+	}
+	if filter.From == nil || filter.To == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Rescan filter must have 'from' and 'to'")
+	}
+	if !filter.From.Before(*filter.To) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Rescan filter 'from' must be before 'to'")
+	}
+	if filter.To.Sub(*filter.From) > maxRescanRange {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Rescan filter range must be at most %s, use `app rescan` for larger ones", maxRescanRange))
+	}
+
+	report, err := h.manager.Rescan(c.Request().Context(), filter)
+	if errors.Is(err, ErrUnknownRule) {
+		log.Printf("Handler: Invalid rescan rule: %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid rescan filter: %v", err))
+	}
+	if err != nil {
+		log.Printf("Handler: Error running rescan: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to rescan transactions")
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// RuleVersion returns the rules config behind a rules_version stored with a verdict.
+func (h *AdminHandler) RuleVersion(c echo.Context) error {
+	version := c.Param("version")
+	rules, err := h.ruleVersions.Get(c.Request().Context(), version)
+	if errors.Is(err, ErrRuleVersionNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		log.Printf("Handler: Error loading rule version %s: %v", version, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load rule version")
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+// UserGraph returns the transfers within hops of a user, 2 by default, over the trailing window, 7
+// days by default, for investigators to see who the user moves money with.
+func (h *AdminHandler) UserGraph(c echo.Context) error {
+	hops := defaultGraphHops
+	if hopsParam := c.QueryParam("hops"); hopsParam != "" {
+		parsed, err := strconv.Atoi(hopsParam)
+		if err != nil || parsed <= 0 || parsed > maxGraphHops {
+			log.Printf("Handler: Invalid value for 'hops' query parameter: %q", hopsParam)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid value for query parameter 'hops', must be 1 to %d: %s", maxGraphHops, hopsParam))
+		}
+		hops = parsed
+	}
+	window := defaultGraphWindow
+	if windowParam := c.QueryParam("window"); windowParam != "" {
+		parsed, err := time.ParseDuration(windowParam)
+		if err != nil || parsed <= 0 {
+			log.Printf("Handler: Invalid value for 'window' query parameter: %q", windowParam)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid value for query parameter 'window': %s", windowParam))
+		}
+		window = parsed
+	}
+
+	userID := c.Param("id")
+	until := time.Now().UTC()
+	graph, err := h.graph.Neighborhood(c.Request().Context(), userID, until.Add(-window), until, hops)
+	if err != nil {
+		log.Printf("Handler: Error loading the transfer graph of user %s: %v", userID, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load the transfer graph")
+	}
+	return c.JSON(http.StatusOK, graph)
+}
+
+func deadLetterID(c echo.Context) (int64, error) {
+	idParam := c.Param("id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		log.Printf("Handler: Invalid dead letter id: %q", idParam)
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid dead letter id: %s", idParam))
+	}
+	return id, nil
+}
+
+func deadLetterError(action string, id int64, err error) error {
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	log.Printf("Handler: Error trying to %s dead letter %d: %v", action, id, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to %s dead letter", action))
+}
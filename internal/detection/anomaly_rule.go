@@ -0,0 +1,126 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+const anomalyRuleName = "Anomaly"
+
+// AnomalyLimits are the checks of AnomalyRule. A zero limit turns its check off.
+type AnomalyLimits struct {
+	MaxZScore          float64 // Of the amount, against the user's amounts of the same type
+	MaxPercentile      float64 // Of the amount, among the user's amounts of the same type, 0-100
+	MinHourShare       float64 // Percent of the user's transactions in the same UTC hour
+	MaxFrequencyZScore float64 // Of the user's transactions in the last 24h, against their daily counts
+}
+
+// AnomalyRule flags transactions that are unusual for the user, compared with their own profile over
+// the lookback period rather than a fixed threshold. Users with fewer than minHistory transactions
+// in the lookback, or of the transaction's type for the amount checks, are not checked: a new user has
+// no normal yet, and the fixed-threshold rules cover them.
+type AnomalyRule struct {
+	repo       Repository
+	lookback   time.Duration
+	minHistory int
+	limits     AnomalyLimits
+	weight     float64
+}
+
+func NewAnomalyRule(repo Repository, lookback time.Duration, minHistory int, limits AnomalyLimits, weight float64) *AnomalyRule {
+	if repo == nil {
+		panic("Repository cannot be nil for AnomalyRule")
+	}
+	return &AnomalyRule{
+		repo:       repo,
+		lookback:   lookback,
+		minHistory: minHistory,
+		limits:     limits,
+		weight:     weight,
+	}
+}
+
+func (r *AnomalyRule) Name() string {
+	return anomalyRuleName
+}
+
+// anomalySignal is one check that found txn unusual.
+type anomalySignal struct {
+	reason              string
+	threshold, observed float64
+}
+
+func (r *AnomalyRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	since := txn.Timestamp.Add(-r.lookback)
+	profile, err := r.repo.Profile(ctx, txn.UserID, since, txn.Timestamp)
+	if err != nil {
+		return Result{}, err
+	}
+	if profile.Transactions < r.minHistory {
+		return Result{}, nil
+	}
+
+	var signals []anomalySignal
+	if amounts := profile.Types[txn.Type]; amounts.Count >= r.minHistory {
+		if r.limits.MaxZScore > 0 {
+			// A user who always pays the same amount is not flagged for paying slightly more.
+			stdDev := max(amounts.StdDev, 0.1*amounts.Mean)
+			if z := (txn.Amount - amounts.Mean) / stdDev; z > r.limits.MaxZScore {
+				reason := fmt.Sprintf("amount %.2f is %.1f standard deviations above the mean %.2f of %d %ss", txn.Amount, z, amounts.Mean, amounts.Count, txn.Type)
+				signals = append(signals, anomalySignal{reason, r.limits.MaxZScore, z})
+			}
+		}
+		if r.limits.MaxPercentile > 0 {
+			below, err := r.repo.Count(ctx, Filter{UserID: txn.UserID, Type: txn.Type, AmountLessThan: &txn.Amount, Since: &since, Before: &txn.Timestamp})
+			if err != nil {
+				return Result{}, err
+			}
+			if percentile := 100 * float64(below) / float64(amounts.Count); percentile > r.limits.MaxPercentile {
+				reason := fmt.Sprintf("amount %.2f is above %.0f%% of %d %ss", txn.Amount, percentile, amounts.Count, txn.Type)
+				signals = append(signals, anomalySignal{reason, r.limits.MaxPercentile, percentile})
+			}
+		}
+	}
+	if r.limits.MinHourShare > 0 {
+		hour := txn.Timestamp.UTC().Hour()
+		if share := 100 * profile.HourShare[hour]; share < r.limits.MinHourShare {
+			reason := fmt.Sprintf("%.1f%% of transactions are at %02d:00 UTC", share, hour)
+			signals = append(signals, anomalySignal{reason, r.limits.MinHourShare, share})
+		}
+	}
+	if r.limits.MaxFrequencyZScore > 0 {
+		dayStart := txn.Timestamp.Add(-24 * time.Hour)
+		count, err := r.repo.Count(ctx, Filter{UserID: txn.UserID, Since: &dayStart, Until: &txn.Timestamp})
+		if err != nil {
+			return Result{}, err
+		}
+		// At least one transaction more than usual, so a user with the same count every day is not flagged for one extra.
+		if z := (float64(count) - profile.DailyMean) / max(profile.DailyStdDev, 1); z > r.limits.MaxFrequencyZScore {
+			reason := fmt.Sprintf("%d transactions in 24h is %.1f standard deviations above the daily mean %.1f", count, z, profile.DailyMean)
+			signals = append(signals, anomalySignal{reason, r.limits.MaxFrequencyZScore, z})
+		}
+	}
+	if len(signals) == 0 {
+		return Result{}, nil
+	}
+
+	reasons := make([]string, 0, len(signals))
+	for _, signal := range signals {
+		reasons = append(reasons, signal.reason)
+	}
+	reason := fmt.Sprintf("unusual for the user over %s: %s", r.lookback, strings.Join(reasons, "; "))
+	evidence := &Evidence{
+		Threshold:             signals[0].threshold,
+		Observed:              signals[0].observed,
+		Window:                r.lookback.String(),
+		RelatedTransactionIDs: []string{txn.ID},
+	}
+	return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
+}
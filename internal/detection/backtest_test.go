@@ -0,0 +1,64 @@
+package detection
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/config"
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBacktester_Run tests that a candidate rule set is compared with the stored flags, and that
+// rules only see the transactions before the one being replayed.
+func TestBacktester_Run(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, tx := range []Transaction{
+		{ID: "bt_before", UserID: "u1", Amount: 20000, Type: model.DepositType, Timestamp: start.Add(-time.Hour), IsSuspicious: true},
+		{ID: "bt_1", UserID: "u1", Amount: 50, Type: model.TransferType, Timestamp: start},
+		{ID: "bt_2", UserID: "u1", Amount: 50, Type: model.TransferType, Timestamp: start.Add(time.Minute)},
+		{ID: "bt_big", UserID: "u1", Amount: 20000, Type: model.DepositType, Timestamp: start.Add(90 * time.Second), IsSuspicious: true},
+		{ID: "bt_3", UserID: "u1", Amount: 50, Type: model.TransferType, Timestamp: start.Add(2 * time.Minute)},
+		{ID: "bt_after", UserID: "u1", Amount: 50, Type: model.TransferType, Timestamp: start.Add(2 * time.Hour)},
+	} {
+		insertTestData(t, db, tx)
+	}
+
+	// Only rapid transfers, which now need 2 transfers instead of 3, deposits in between or not.
+	candidate, err := config.ParseRules("yaml", strings.NewReader(`
+high_volume:
+  mode: "disabled"
+frequent_small_transactions:
+  mode: "disabled"
+rapid_transfers:
+  weight: 60
+  min_consecutive: 2
+  match: "any"
+`))
+	require.NoError(t, err)
+
+	report, err := NewBacktester(repo).Run(ctx, candidate, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Transactions)
+	assert.Equal(t, 2, report.Flagged)
+	assert.Equal(t, map[string]int{rapidTransfersRuleName: 2}, report.RuleHits)
+	assert.Equal(t, []string{"bt_2", "bt_3"}, report.NewlyFlagged, "bt_1 must not see the later transfers")
+	assert.Equal(t, []string{"bt_big"}, report.NoLongerFlagged)
+
+	stored, err := repo.Get(ctx, Filter{UserID: "u1", Type: model.TransferType})
+	require.NoError(t, err)
+	for _, tx := range stored {
+		assert.False(t, tx.IsSuspicious, "A backtest must not change stored flags")
+	}
+
+	candidate.Custom = []config.CustomRule{{Name: "Broken", Weight: 10, Expression: "amount >"}}
+	_, err = NewBacktester(repo).Run(ctx, candidate, start, start.Add(time.Hour))
+	require.ErrorIs(t, err, ErrInvalidRules, "An expression that does not compile is the caller's mistake")
+}
@@ -0,0 +1,69 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+const circularFlowRuleName = "CircularFlow"
+
+// CircularFlowRule flags a transfer that brings money back to where it came from: a circle of at
+// most maxHops transfers, each after the one before, all within the window, e.g. u1 → u2 → u3 → u1.
+type CircularFlowRule struct {
+	graph          *TransferGraph
+	windowDuration time.Duration
+	maxHops        int
+	weight         float64
+}
+
+func NewCircularFlowRule(repo Repository, windowDuration time.Duration, maxHops int, weight float64) *CircularFlowRule {
+	if repo == nil {
+		panic("Repository cannot be nil for CircularFlowRule")
+	}
+	return &CircularFlowRule{
+		graph:          NewTransferGraph(repo),
+		windowDuration: windowDuration,
+		maxHops:        maxHops,
+		weight:         weight,
+	}
+}
+
+func (r *CircularFlowRule) Name() string {
+	return circularFlowRuleName
+}
+
+func (r *CircularFlowRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cycle, err := r.graph.Cycle(ctx, txn, r.windowDuration, r.maxHops)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to search circular flows: %w", err)
+	}
+	if cycle == nil {
+		return Result{}, nil
+	}
+
+	nodes := make([]string, 0, len(cycle)+1)
+	nodes = append(nodes, cycle[0].From)
+	ids := make([]string, len(cycle))
+	for i, edge := range cycle {
+		nodes = append(nodes, edge.To)
+		ids[len(cycle)-1-i] = edge.TransactionID
+	}
+	reason := fmt.Sprintf("money returned to %s within %s through %s: %s", cycle[0].From, r.windowDuration, strings.Join(nodes, " → "), summarizeIDs(ids))
+	return Result{
+		Score:  r.weight,
+		Reason: reason,
+		Evidence: &Evidence{
+			Observed:              float64(len(cycle)), // Transfers in the circle
+			Window:                r.windowDuration.String(),
+			RelatedTransactionIDs: ids,
+			Counterparties:        nodes[:len(nodes)-1], // In the order the money moved
+		},
+	}, nil
+}
@@ -0,0 +1,132 @@
+package detection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a transaction whose detection failed on every attempt allowed by the RetryPolicy.
+type DeadLetter struct {
+	ID            int64     `json:"id" db:"id"`
+	TransactionID string    `json:"transaction_id" db:"transaction_id"`
+	Rule          string    `json:"rule,omitempty" db:"rule"` // Empty when the failure was not in a rule, e.g. storing the verdict
+	Error         string    `json:"error" db:"error"`
+	Attempts      int       `json:"attempts" db:"attempts"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
+type DeadLetterRepository interface {
+	Migrate(ctx context.Context) error
+	List(ctx context.Context, limit int) ([]DeadLetter, error)
+	Replay(ctx context.Context, id int64) error
+	Discard(ctx context.Context, id int64) error
+}
+
+type sqliteDeadLetterRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteDeadLetterRepository(db *sql.DB) DeadLetterRepository {
+	if db == nil {
+		panic("database connection (*sql.DB) is required for NewSQLiteDeadLetterRepository")
+	}
+	return &sqliteDeadLetterRepository{db: db}
+}
+
+func (r *sqliteDeadLetterRepository) Migrate(ctx context.Context) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS dead_letters (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        transaction_id TEXT NOT NULL,
+        rule TEXT NOT NULL DEFAULT '',
+        error TEXT NOT NULL,
+        attempts INTEGER NOT NULL,
+        created_at TIMESTAMP NOT NULL
+    );`
+	if _, err := r.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create dead_letters table: %w", err)
+	}
+	return nil
+}
+
+func (r *sqliteDeadLetterRepository) List(ctx context.Context, limit int) ([]DeadLetter, error) {
+	query := `SELECT id, transaction_id, rule, error, attempts, created_at FROM dead_letters ORDER BY id DESC LIMIT ?`
+	rows, err := r.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	deadLetters := make([]DeadLetter, 0)
+	for rows.Next() {
+		var dl DeadLetter
+		if err := rows.Scan(&dl.ID, &dl.TransactionID, &dl.Rule, &dl.Error, &dl.Attempts, &dl.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter row: %w", err)
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating dead letter rows: %w", err)
+	}
+	return deadLetters, nil
+}
+
+// Replay puts the dead-lettered transaction back on the outbox with a fresh attempt count and
+// removes the dead letter, in one SQL transaction.
+func (r *sqliteDeadLetterRepository) Replay(ctx context.Context, id int64) (err error) {
+	sqlTx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin replay of dead letter %d: %w", id, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = sqlTx.Rollback()
+		}
+	}()
+
+	var transactionID string
+	err = sqlTx.QueryRowContext(ctx, `SELECT transaction_id FROM dead_letters WHERE id = ?`, id).Scan(&transactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: id %d", ErrDeadLetterNotFound, id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load dead letter %d: %w", id, err)
+	}
+
+	now := time.Now().UTC()
+	if _, err = sqlTx.ExecContext(ctx, `INSERT INTO transaction_outbox (transaction_id, created_at) VALUES (?, ?)`, transactionID, now); err != nil {
+		return fmt.Errorf("failed to enqueue transaction %s for replay: %w", transactionID, err)
+	}
+	query := `UPDATE transactions SET analysis_status = ?, status_updated_at = ? WHERE id = ?`
+	if _, err = sqlTx.ExecContext(ctx, query, StatusPending, now, transactionID); err != nil {
+		return fmt.Errorf("failed to reset analysis status of transaction %s: %w", transactionID, err)
+	}
+	if _, err = sqlTx.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete dead letter %d: %w", id, err)
+	}
+
+	if err = sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit replay of dead letter %d: %w", id, err)
+	}
+	return nil
+}
+
+func (r *sqliteDeadLetterRepository) Discard(ctx context.Context, id int64) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete dead letter %d: %w", id, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected for dead letter %d: %w", id, err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: id %d", ErrDeadLetterNotFound, id)
+	}
+	return nil
+}
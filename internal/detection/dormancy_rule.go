@@ -0,0 +1,117 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+const dormancyRuleName = "Dormancy"
+
+// DormancyRule flags an account that had no transactions for the dormancy period and then suddenly
+// moves a large amount: a single transaction of at least minAmount, or at least velocityAmount in
+// total within the velocity window. The window is what counts as sudden, so the transactions right
+// after the reactivating one are checked as well. A zero amount turns its check off; accounts without
+// any earlier transaction are new rather than dormant.
+type DormancyRule struct {
+	repo           Repository
+	period         time.Duration
+	minAmount      float64
+	velocityWindow time.Duration
+	velocityAmount float64
+	weight         float64
+}
+
+func NewDormancyRule(repo Repository, period time.Duration, minAmount float64, velocityWindow time.Duration, velocityAmount float64, weight float64) *DormancyRule {
+	if repo == nil {
+		panic("Repository cannot be nil for DormancyRule")
+	}
+	return &DormancyRule{
+		repo:           repo,
+		period:         period,
+		minAmount:      minAmount,
+		velocityWindow: velocityWindow,
+		velocityAmount: velocityAmount,
+		weight:         weight,
+	}
+}
+
+func (r *DormancyRule) Name() string {
+	return dormancyRuleName
+}
+
+func (r *DormancyRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	if r.velocityAmount == 0 && txn.Amount < r.minAmount {
+		return Result{}, nil // Nothing to look up
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if r.minAmount > 0 && txn.Amount >= r.minAmount {
+		previous, found, err := r.repo.Last(ctx, Filter{UserID: txn.UserID, Before: &txn.Timestamp})
+		if err != nil {
+			return Result{}, err
+		}
+		if found && txn.Timestamp.Sub(previous.Timestamp) >= r.period {
+			reason := fmt.Sprintf("%s: amount %.2f is at least %.2f", r.dormant(previous, txn.Timestamp), txn.Amount, r.minAmount)
+			evidence := &Evidence{
+				Threshold:             r.minAmount,
+				Observed:              txn.Amount,
+				Window:                r.period.String(),
+				RelatedTransactionIDs: []string{txn.ID, previous.ID},
+			}
+			return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
+		}
+	}
+	if r.velocityAmount == 0 {
+		return Result{}, nil
+	}
+
+	// The account reactivated with the first transaction in the window, which is no later than txn, so
+	// txn coming too soon after the last one before the window already rules dormancy out.
+	windowStart := txn.Timestamp.Add(-r.velocityWindow)
+	previous, found, err := r.repo.Last(ctx, Filter{UserID: txn.UserID, Before: &windowStart})
+	if err != nil {
+		return Result{}, err
+	}
+	if !found || txn.Timestamp.Sub(previous.Timestamp) < r.period {
+		return Result{}, nil
+	}
+
+	filters := Filter{UserID: txn.UserID, Since: &windowStart, Until: &txn.Timestamp}
+	total, err := r.repo.Sum(ctx, filters)
+	if err != nil {
+		return Result{}, err
+	}
+	if total < r.velocityAmount {
+		return Result{}, nil
+	}
+
+	// Only load the transactions for the evidence, most evaluations stop at the sum.
+	reactivated, err := r.repo.Get(ctx, filters)
+	if err != nil {
+		return Result{}, err
+	}
+	first := reactivated[len(reactivated)-1].Timestamp
+	if first.Sub(previous.Timestamp) < r.period {
+		return Result{}, nil
+	}
+	ids := append(transactionIDs(reactivated), previous.ID)
+	reason := fmt.Sprintf("%s: %.2f moved within %s, at least %.2f: %s", r.dormant(previous, first), total, r.velocityWindow, r.velocityAmount, summarizeIDs(ids))
+	evidence := &Evidence{
+		Threshold:             r.velocityAmount,
+		Observed:              total,
+		Window:                r.velocityWindow.String(),
+		RelatedTransactionIDs: ids,
+	}
+	return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
+}
+
+// dormant describes the gap between previous and the reactivating transaction at reactivated.
+func (r *DormancyRule) dormant(previous Transaction, reactivated time.Time) string {
+	return fmt.Sprintf("first activity after %.1f days without transactions, the last being %s on %s",
+		reactivated.Sub(previous.Timestamp).Hours()/24, previous.ID, previous.Timestamp.Format(time.DateOnly))
+}
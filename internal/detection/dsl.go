@@ -0,0 +1,577 @@
+package detection
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+// The rule expression language. A rule is a boolean expression over the transaction being evaluated
+// and aggregates over the same user's transactions in a trailing window, for example:
+//
+//	type == "withdrawal" && sum(24h, type == "withdrawal") > 5000
+//	count(1h, amount < 100) > 10 || amount > 10000
+//
+// Fields: amount, type, user_id, hour (UTC hour of day, 0-23), channel and counterparty_id ("" when
+// not set).
+// Aggregates: count, sum, avg, min and max, taking a window (e.g. 30s, 5m, 24h, 7d) and an optional
+// filter. Inside the filter, fields refer to the aggregated transaction. sum, avg, min and max are
+// over amount and are 0 when nothing matches.
+// Operators, loosest first: || (or), && (and), == != < <= > >=, + -, * /, ! (not) and unary -.
+
+var ErrExpression = errors.New("invalid rule expression")
+
+type valueKind int
+
+const (
+	kindNumber valueKind = iota
+	kindString
+	kindBool
+	kindDuration
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindString:
+		return "string"
+	case kindBool:
+		return "bool"
+	default:
+		return "duration"
+	}
+}
+
+// evalEnv is what an expression is evaluated against. history returns the user's transactions in the
+// window ending at the evaluated transaction, and counted, when set, is told about each of them an
+// aggregate includes.
+type evalEnv struct {
+	txn     model.Transaction
+	history func(window time.Duration) ([]Transaction, error)
+	counted func(txn Transaction)
+}
+
+type exprNode interface {
+	kind() valueKind
+	eval(env *evalEnv) (any, error)
+}
+
+// ---- Lexer ----
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokNumber
+	tokDuration
+	tokString
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	pos  int
+	num  float64
+	dur  time.Duration
+}
+
+var wordOperators = map[string]string{"and": "&&", "or": "||", "not": "!"}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(input) && (isDigit(input[i]) || input[i] == '.' || unicode.IsLetter(rune(input[i]))) {
+				i++
+			}
+			tok, err := numberOrDuration(input[start:i], start)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(input[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated string at position %d", ErrExpression, i)
+			}
+			tokens = append(tokens, token{typ: tokString, text: input[i+1 : i+1+end], pos: i})
+			i += end + 2
+		case unicode.IsLetter(rune(c)) || c == '_':
+			start := i
+			for i < len(input) && (unicode.IsLetter(rune(input[i])) || isDigit(input[i]) || input[i] == '_') {
+				i++
+			}
+			word := input[start:i]
+			if op, ok := wordOperators[strings.ToLower(word)]; ok {
+				tokens = append(tokens, token{typ: tokOp, text: op, pos: start})
+			} else {
+				tokens = append(tokens, token{typ: tokIdent, text: word, pos: start})
+			}
+		case c == '(':
+			tokens = append(tokens, token{typ: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{typ: tokRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{typ: tokComma, text: ",", pos: i})
+			i++
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "!"} {
+				if strings.HasPrefix(input[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("%w: unexpected character %q at position %d", ErrExpression, c, i)
+			}
+			tokens = append(tokens, token{typ: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{typ: tokEOF, pos: len(input)}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// numberOrDuration parses 12, 0.5, or durations such as 30s, 5m, 24h, 1h30m and 7d.
+func numberOrDuration(text string, pos int) (token, error) {
+	if num, err := strconv.ParseFloat(text, 64); err == nil {
+		return token{typ: tokNumber, text: text, pos: pos, num: num}, nil
+	}
+	goDuration := text
+	if strings.HasSuffix(text, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(text, "d"))
+		if err != nil {
+			return token{}, fmt.Errorf("%w: invalid duration %q at position %d", ErrExpression, text, pos)
+		}
+		goDuration = fmt.Sprintf("%dh", days*24)
+	}
+	dur, err := time.ParseDuration(goDuration)
+	if err != nil {
+		return token{}, fmt.Errorf("%w: invalid number or duration %q at position %d", ErrExpression, text, pos)
+	}
+	return token{typ: tokDuration, text: text, pos: pos, dur: dur}, nil
+}
+
+// ---- Parser ----
+
+type parser struct {
+	tokens      []token
+	pos         int
+	inAggregate bool
+}
+
+// parseExpression parses and type checks input, which must evaluate to a bool.
+func parseExpression(input string) (exprNode, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.typ != tokEOF {
+		return nil, fmt.Errorf("%w: unexpected %q at position %d", ErrExpression, tok.text, tok.pos)
+	}
+	if node.kind() != kindBool {
+		return nil, fmt.Errorf("%w: expression must be a condition, got a %s", ErrExpression, node.kind())
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.typ != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) acceptOp(ops ...string) (token, bool) {
+	tok := p.peek()
+	if tok.typ != tokOp {
+		return tok, false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			p.pos++
+			return tok, true
+		}
+	}
+	return tok, false
+}
+
+func (p *parser) parseBinaryLevel(ops []string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.acceptOp(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = newBinary(tok, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseOr() (exprNode, error) {
+	return p.parseBinaryLevel([]string{"||"}, p.parseAnd)
+}
+
+func (p *parser) parseAnd() (exprNode, error) {
+	return p.parseBinaryLevel([]string{"&&"}, p.parseComparison)
+}
+
+func (p *parser) parseComparison() (exprNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	tok, ok := p.acceptOp("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return newBinary(tok, left, right)
+}
+
+func (p *parser) parseAdditive() (exprNode, error) {
+	return p.parseBinaryLevel([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *parser) parseMultiplicative() (exprNode, error) {
+	return p.parseBinaryLevel([]string{"*", "/"}, p.parseUnary)
+}
+
+func (p *parser) parseUnary() (exprNode, error) {
+	tok, ok := p.acceptOp("!", "-")
+	if !ok {
+		return p.parsePrimary()
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	want := kindNumber
+	if tok.text == "!" {
+		want = kindBool
+	}
+	if operand.kind() != want {
+		return nil, fmt.Errorf("%w: %q at position %d needs a %s, got a %s", ErrExpression, tok.text, tok.pos, want, operand.kind())
+	}
+	return &unaryNode{op: tok.text, operand: operand}, nil
+}
+
+func (p *parser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.typ {
+	case tokNumber:
+		return &literalNode{value: tok.num, valueKind: kindNumber}, nil
+	case tokDuration:
+		return &literalNode{value: tok.dur, valueKind: kindDuration}, nil
+	case tokString:
+		return &literalNode{value: tok.text, valueKind: kindString}, nil
+	case tokLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.typ != tokRParen {
+			return nil, fmt.Errorf("%w: expected ')' at position %d", ErrExpression, closing.pos)
+		}
+		return node, nil
+	case tokIdent:
+		if p.peek().typ == tokLParen {
+			return p.parseAggregate(tok)
+		}
+		switch strings.ToLower(tok.text) {
+		case "true":
+			return &literalNode{value: true, valueKind: kindBool}, nil
+		case "false":
+			return &literalNode{value: false, valueKind: kindBool}, nil
+		}
+		field, ok := fields[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown field %q at position %d", ErrExpression, tok.text, tok.pos)
+		}
+		return field, nil
+	case tokEOF:
+		return nil, fmt.Errorf("%w: unexpected end of expression", ErrExpression)
+	default:
+		return nil, fmt.Errorf("%w: unexpected %q at position %d", ErrExpression, tok.text, tok.pos)
+	}
+}
+
+func (p *parser) parseAggregate(name token) (exprNode, error) {
+	fn := strings.ToLower(name.text)
+	if _, ok := aggregates[fn]; !ok {
+		return nil, fmt.Errorf("%w: unknown function %q at position %d", ErrExpression, name.text, name.pos)
+	}
+	if p.inAggregate {
+		return nil, fmt.Errorf("%w: %s at position %d cannot be nested in another aggregate", ErrExpression, fn, name.pos)
+	}
+	p.inAggregate = true
+	defer func() { p.inAggregate = false }()
+	p.next() // (
+
+	windowTok := p.next()
+	if windowTok.typ != tokDuration || windowTok.dur <= 0 {
+		return nil, fmt.Errorf("%w: %s at position %d needs a window such as 1h as its first argument", ErrExpression, fn, name.pos)
+	}
+	node := &aggregateNode{fn: fn, window: windowTok.dur}
+
+	if p.peek().typ == tokComma {
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if filter.kind() != kindBool {
+			return nil, fmt.Errorf("%w: filter of %s at position %d must be a condition, got a %s", ErrExpression, fn, name.pos, filter.kind())
+		}
+		node.filter = filter
+	}
+	if closing := p.next(); closing.typ != tokRParen {
+		return nil, fmt.Errorf("%w: expected ')' at position %d", ErrExpression, closing.pos)
+	}
+	return node, nil
+}
+
+// ---- Nodes ----
+
+type literalNode struct {
+	value     any
+	valueKind valueKind
+}
+
+func (n *literalNode) kind() valueKind            { return n.valueKind }
+func (n *literalNode) eval(*evalEnv) (any, error) { return n.value, nil }
+
+type fieldNode struct {
+	valueKind valueKind
+	get       func(txn model.Transaction) any
+}
+
+var fields = map[string]*fieldNode{
+	"amount":          {kindNumber, func(txn model.Transaction) any { return txn.Amount }},
+	"type":            {kindString, func(txn model.Transaction) any { return txn.Type }},
+	"user_id":         {kindString, func(txn model.Transaction) any { return txn.UserID }},
+	"hour":            {kindNumber, func(txn model.Transaction) any { return float64(txn.Timestamp.UTC().Hour()) }},
+	"channel":         {kindString, func(txn model.Transaction) any { return txn.Channel }},
+	"counterparty_id": {kindString, func(txn model.Transaction) any { return txn.CounterpartyID }},
+}
+
+func (n *fieldNode) kind() valueKind                { return n.valueKind }
+func (n *fieldNode) eval(env *evalEnv) (any, error) { return n.get(env.txn), nil }
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) kind() valueKind { return n.operand.kind() }
+
+func (n *unaryNode) eval(env *evalEnv) (any, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !v.(bool), nil
+	}
+	return -v.(float64), nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+	resultKind  valueKind
+}
+
+// newBinary type checks an operator application. Durations can only be compared with each other.
+func newBinary(op token, left, right exprNode) (exprNode, error) {
+	mismatch := fmt.Errorf("%w: %q at position %d cannot be applied to a %s and a %s", ErrExpression, op.text, op.pos, left.kind(), right.kind())
+	switch op.text {
+	case "&&", "||":
+		if left.kind() != kindBool || right.kind() != kindBool {
+			return nil, mismatch
+		}
+		return &binaryNode{op: op.text, left: left, right: right, resultKind: kindBool}, nil
+	case "==", "!=":
+		if left.kind() != right.kind() {
+			return nil, mismatch
+		}
+	case "<", "<=", ">", ">=":
+		if left.kind() != right.kind() || (left.kind() != kindNumber && left.kind() != kindDuration) {
+			return nil, mismatch
+		}
+	default: // + - * /
+		if left.kind() != kindNumber || right.kind() != kindNumber {
+			return nil, mismatch
+		}
+		return &binaryNode{op: op.text, left: left, right: right, resultKind: kindNumber}, nil
+	}
+	return &binaryNode{op: op.text, left: left, right: right, resultKind: kindBool}, nil
+}
+
+func (n *binaryNode) kind() valueKind { return n.resultKind }
+
+func (n *binaryNode) eval(env *evalEnv) (any, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// Short circuit, which also skips the aggregate queries on the right when possible.
+	if n.op == "&&" && !l.(bool) || n.op == "||" && l.(bool) {
+		return l, nil
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		return r, nil
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	}
+
+	if ld, ok := l.(time.Duration); ok {
+		l, r = float64(ld), float64(r.(time.Duration))
+	}
+	lf, rf := l.(float64), r.(float64)
+	switch n.op {
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	default:
+		if rf == 0 {
+			return 0.0, nil // Keeps e.g. sum(1h) / count(1h) usable when there is no history
+		}
+		return lf / rf, nil
+	}
+}
+
+type aggregateNode struct {
+	fn     string
+	window time.Duration
+	filter exprNode
+}
+
+var aggregates = map[string]func(amounts []float64) float64{
+	"count": func(amounts []float64) float64 { return float64(len(amounts)) },
+	"sum":   sumAmounts,
+	"avg": func(amounts []float64) float64 {
+		if len(amounts) == 0 {
+			return 0
+		}
+		return sumAmounts(amounts) / float64(len(amounts))
+	},
+	"min": func(amounts []float64) float64 {
+		if len(amounts) == 0 {
+			return 0
+		}
+		lowest := amounts[0]
+		for _, a := range amounts[1:] {
+			lowest = min(lowest, a)
+		}
+		return lowest
+	},
+	"max": func(amounts []float64) float64 {
+		if len(amounts) == 0 {
+			return 0
+		}
+		highest := amounts[0]
+		for _, a := range amounts[1:] {
+			highest = max(highest, a)
+		}
+		return highest
+	},
+}
+
+func sumAmounts(amounts []float64) float64 {
+	total := 0.0
+	for _, a := range amounts {
+		total += a
+	}
+	return total
+}
+
+func (n *aggregateNode) kind() valueKind { return kindNumber }
+
+func (n *aggregateNode) eval(env *evalEnv) (any, error) {
+	history, err := env.history(n.window)
+	if err != nil {
+		return nil, err
+	}
+
+	amounts := make([]float64, 0, len(history))
+	for _, past := range history {
+		if n.filter != nil {
+			rowEnv := &evalEnv{txn: past.toModel()}
+			matches, err := n.filter.eval(rowEnv)
+			if err != nil {
+				return nil, err
+			}
+			if !matches.(bool) {
+				continue
+			}
+		}
+		amounts = append(amounts, past.Amount)
+		if env.counted != nil {
+			env.counted(past)
+		}
+	}
+	return aggregates[n.fn](amounts), nil
+}
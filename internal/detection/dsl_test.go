@@ -0,0 +1,94 @@
+package detection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseExpression_Errors tests that invalid expressions are rejected when the rule is compiled.
+func TestParseExpression_Errors(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":          `balance > 10`,
+		"unknown function":       `median(1h) > 10`,
+		"not a condition":        `amount + 1`,
+		"type mismatch":          `amount == "withdrawal"`,
+		"missing window":         `count(amount > 10) > 1`,
+		"non-bool filter":        `sum(1h, amount) > 1`,
+		"nested aggregate":       `count(1h, amount > avg(1h)) > 1`,
+		"unterminated string":    `type == "withdrawal`,
+		"unbalanced parenthesis": `(amount > 10`,
+		"trailing tokens":        `amount > 10 10`,
+		"invalid duration":       `count(1x) > 1`,
+	}
+	for name, expression := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseExpression(expression)
+			require.ErrorIs(t, err, ErrExpression)
+		})
+	}
+}
+
+// TestExpressionRule tests expressions on the evaluated transaction and aggregates over the user's history.
+func TestExpressionRule(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	history := []Transaction{
+		{ID: "w1", UserID: "user_1", Amount: 3000, Type: model.WithdrawalType, Timestamp: now.Add(-30 * time.Hour)}, // Outside 24h
+		{ID: "w2", UserID: "user_1", Amount: 2500, Type: model.WithdrawalType, Timestamp: now.Add(-20 * time.Hour)},
+		{ID: "d1", UserID: "user_1", Amount: 9000, Type: model.DepositType, Timestamp: now.Add(-2 * time.Hour)},
+		{ID: "w3", UserID: "user_1", Amount: 2000, Type: model.WithdrawalType, Timestamp: now.Add(-time.Hour)},
+		{ID: "w4", UserID: "user_2", Amount: 9000, Type: model.WithdrawalType, Timestamp: now.Add(-time.Hour)}, // Other user
+		{ID: "w5", UserID: "user_1", Amount: 1000, Type: model.WithdrawalType, Timestamp: now},
+	}
+	for _, tx := range history {
+		insertTestData(t, db, tx)
+	}
+	current := model.Transaction{ID: "w5", UserID: "user_1", Amount: 1000, Type: model.WithdrawalType, Timestamp: now}
+
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{`type == "withdrawal" && sum(24h, type == "withdrawal") > 5000`, true}, // 2500 + 2000 + 1000
+		{`sum(24h, type == "withdrawal") > 6000`, false},
+		{`sum(2d, type == "withdrawal") > 6000`, true},
+		{`count(24h) == 4 and max(24h) == 9000 and min(24h) == 1000`, true},
+		{`avg(24h, type != "deposit") * 3 == 5500`, true},
+		{`amount > 5000 or not (user_id == "user_1")`, false},
+		{`count(1h, amount < 0) == 0 && sum(1h, amount < 0) / count(1h, amount < 0) == 0`, true},
+		{`-amount < -500 && hour >= 0 && 90m > 1h`, true},
+		{`channel == "" && count(24h, counterparty_id != "") == 0`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			rule, err := NewExpressionRule(repo, "Custom", tt.expression, 50)
+			require.NoError(t, err)
+
+			result, err := rule.DetectSuspiciousActivity(current)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, result.Score > 0)
+			if tt.want {
+				assert.Equal(t, 50.0, result.Score)
+				require.NotNil(t, result.Evidence)
+			}
+		})
+	}
+
+	t.Run("evidence lists the aggregated transactions", func(t *testing.T) {
+		rule, err := NewExpressionRule(repo, "Custom", `sum(24h, type == "withdrawal") > 5000`, 50)
+		require.NoError(t, err)
+
+		result, err := rule.DetectSuspiciousActivity(current)
+		require.NoError(t, err)
+		require.NotNil(t, result.Evidence)
+		assert.Equal(t, "24h0m0s", result.Evidence.Window)
+		assert.Equal(t, []string{"w5", "w3", "w2"}, result.Evidence.RelatedTransactionIDs)
+		assert.Contains(t, result.Reason, "w5, w3, w2")
+	})
+}
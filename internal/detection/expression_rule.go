@@ -0,0 +1,127 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+// ExpressionRule is a rule written in the expression language described in dsl.go, so new rules can
+// be added through config instead of code.
+type ExpressionRule struct {
+	repo       Repository
+	name       string
+	expression string
+	root       exprNode
+	maxWindow  time.Duration // Largest aggregate window, so one query serves every aggregate
+	weight     float64
+}
+
+// NewExpressionRule compiles expression. The returned error wraps ErrExpression and points at the
+// offending position.
+func NewExpressionRule(repo Repository, name, expression string, weight float64) (*ExpressionRule, error) {
+	if repo == nil {
+		panic("Repository cannot be nil for ExpressionRule")
+	}
+	root, err := parseExpression(expression)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", name, err)
+	}
+	return &ExpressionRule{
+		repo:       repo,
+		name:       name,
+		expression: expression,
+		root:       root,
+		maxWindow:  largestWindow(root),
+		weight:     weight,
+	}, nil
+}
+
+func (r *ExpressionRule) Name() string {
+	return r.name
+}
+
+func (r *ExpressionRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	var history []Transaction
+	loaded := false
+	var related []string
+	seen := map[string]bool{}
+	env := &evalEnv{
+		txn: txn,
+		history: func(window time.Duration) ([]Transaction, error) {
+			if !loaded {
+				var err error
+				if history, err = r.loadHistory(txn); err != nil {
+					return nil, err
+				}
+				loaded = true
+			}
+			windowStart := txn.Timestamp.Add(-window)
+			var inWindow []Transaction
+			for _, past := range history {
+				if !past.Timestamp.Before(windowStart) {
+					inWindow = append(inWindow, past)
+				}
+			}
+			return inWindow, nil
+		},
+		counted: func(past Transaction) {
+			if !seen[past.ID] {
+				seen[past.ID] = true
+				related = append(related, past.ID)
+			}
+		},
+	}
+
+	matched, err := r.root.eval(env)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to evaluate rule %s: %w", r.name, err)
+	}
+	if !matched.(bool) {
+		return Result{}, nil
+	}
+
+	// Expressions without aggregates only look at txn itself.
+	reason := "matched " + r.expression
+	evidence := &Evidence{RelatedTransactionIDs: []string{txn.ID}}
+	if r.maxWindow > 0 {
+		evidence.Window = r.maxWindow.String()
+		evidence.RelatedTransactionIDs = related
+		if len(related) > 0 {
+			reason += ": " + summarizeIDs(related)
+		}
+	}
+	return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
+}
+
+// loadHistory loads the rows of the largest window once. Unlike the built-in rules, an expression
+// cannot use Count or Sum: aggregate filters are arbitrary expressions, evaluated here, and the
+// counted rows are the evidence.
+func (r *ExpressionRule) loadHistory(txn model.Transaction) ([]Transaction, error) {
+	windowStart := txn.Timestamp.Add(-r.maxWindow)
+	filters := Filter{
+		UserID: txn.UserID,
+		Since:  &windowStart,
+		Until:  &txn.Timestamp,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return r.repo.Get(ctx, filters)
+}
+
+func largestWindow(node exprNode) time.Duration {
+	switch n := node.(type) {
+	case *aggregateNode:
+		return n.window
+	case *unaryNode:
+		return largestWindow(n.operand)
+	case *binaryNode:
+		return max(largestWindow(n.left), largestWindow(n.right))
+	default:
+		return 0
+	}
+}
@@ -2,6 +2,7 @@ package detection
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/jasimvs/sample-go-svc/internal/model"
@@ -14,9 +15,10 @@ type FrequentSmallTransactionsRule struct {
 	maxCount        int
 	thresholdAmount float64
 	windowDuration  time.Duration
+	weight          float64
 }
 
-func NewFrequentSmallTransactionsRule(repo Repository, maxCount int, thresholdAmount float64, windowDuration time.Duration) *FrequentSmallTransactionsRule {
+func NewFrequentSmallTransactionsRule(repo Repository, maxCount int, thresholdAmount float64, windowDuration time.Duration, weight float64) *FrequentSmallTransactionsRule {
 	if repo == nil {
 		panic("Repository cannot be nil for FrequentSmallTransactionsRule")
 	}
@@ -25,11 +27,17 @@ func NewFrequentSmallTransactionsRule(repo Repository, maxCount int, thresholdAm
 		maxCount:        maxCount,
 		thresholdAmount: thresholdAmount,
 		windowDuration:  windowDuration,
+		weight:          weight,
 	}
 }
-func (r *FrequentSmallTransactionsRule) DetectSuspiciousActivity(txn model.Transaction) (bool, string, error) {
+
+func (r *FrequentSmallTransactionsRule) Name() string {
+	return frequentSmallTransactionsRuleName
+}
+
+func (r *FrequentSmallTransactionsRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
 	if txn.Amount >= r.thresholdAmount {
-		return false, "", nil
+		return Result{}, nil
 	}
 
 	windowStart := txn.Timestamp.Add(-r.windowDuration)
@@ -38,20 +46,34 @@ func (r *FrequentSmallTransactionsRule) DetectSuspiciousActivity(txn model.Trans
 		UserID:         txn.UserID,
 		AmountLessThan: &r.thresholdAmount,
 		Since:          &windowStart,
+		Until:          &txn.Timestamp,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	recentTxns, err := r.repo.Get(ctx, filters)
+	count, err := r.repo.Count(ctx, filters)
 	if err != nil {
-		return false, "", err
+		return Result{}, err
 	}
 
-	count := len(recentTxns)
 	if count > r.maxCount {
-		return true, frequentSmallTransactionsRuleName, nil
+		// Only load the transactions for the evidence, most evaluations stop at the count.
+		recentTxns, err := r.repo.Get(ctx, filters)
+		if err != nil {
+			return Result{}, err
+		}
+		count = len(recentTxns)
+		ids := transactionIDs(recentTxns)
+		reason := fmt.Sprintf("%d transactions below %.2f within %s, more than %d: %s", count, r.thresholdAmount, r.windowDuration, r.maxCount, summarizeIDs(ids))
+		evidence := &Evidence{
+			Threshold:             float64(r.maxCount),
+			Observed:              float64(count),
+			Window:                r.windowDuration.String(),
+			RelatedTransactionIDs: ids,
+		}
+		return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
 	}
 
-	return false, "", nil
+	return Result{}, nil
 }
@@ -0,0 +1,193 @@
+package detection
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+const (
+	maxGraphEdges = 500 // Caps the subgraph returned by TransferGraph.Neighborhood
+	// Cap the users and transfers one TransferGraph.Cycle search visits, so a counterparty with many
+	// incoming transfers cannot turn one evaluation into hundreds of queries.
+	maxCycleNodes = 50
+	maxCycleEdges = 1000
+)
+
+var errCycleBudget = errors.New("cycle search budget exhausted")
+
+// Edge is a transfer in the transaction graph, from the sending user to the counterparty.
+type Edge struct {
+	TransactionID      string    `json:"transaction_id"`
+	From               string    `json:"from"`
+	To                 string    `json:"to"`
+	Amount             float64   `json:"amount"`
+	Timestamp          time.Time `json:"timestamp"`
+	SourceAccount      string    `json:"source_account,omitempty"`
+	DestinationAccount string    `json:"destination_account,omitempty"`
+}
+
+// Graph is part of the transaction graph. Truncated means it was cut off at maxGraphEdges.
+type Graph struct {
+	Nodes     []string `json:"nodes"`
+	Edges     []Edge   `json:"edges"` // Oldest first
+	Truncated bool     `json:"truncated"`
+}
+
+// TransferGraph is the graph of the stored transfers: users and counterparties are the nodes, and
+// every transfer with a counterparty is an edge. It is queried from the Repository one node at a
+// time rather than kept in memory, so searches only load the transfers around the nodes they visit.
+type TransferGraph struct {
+	repo Repository
+}
+
+func NewTransferGraph(repo Repository) *TransferGraph {
+	if repo == nil {
+		panic("Repository cannot be nil for TransferGraph")
+	}
+	return &TransferGraph{repo: repo}
+}
+
+// Cycle looks for transfers that moved money from txn's counterparty back to its sender, one after the
+// other within window before txn, so that txn closes a circle of at most maxHops transfers. It returns
+// the circle oldest transfer first, ending with txn, or nil when there is none. A search that runs out
+// of its budget of users and transfers is logged and also returns nil.
+func (g *TransferGraph) Cycle(ctx context.Context, txn model.Transaction, window time.Duration, maxHops int) ([]Edge, error) {
+	if txn.Type != model.TransferType || txn.CounterpartyID == "" || txn.CounterpartyID == txn.UserID {
+		return nil, nil
+	}
+	windowStart := txn.Timestamp.Add(-window)
+	origin := txn.CounterpartyID
+
+	// searched remembers, per node, the latest time and most hops it was searched with and nothing
+	// found; a search with an earlier time and no more hops cannot find anything either.
+	type bound struct {
+		until time.Time
+		hops  int
+	}
+	searched := make(map[string]bound)
+	onPath := map[string]bool{txn.UserID: true}
+	var nodes, edges int
+
+	// search walks the transfers into node backwards in time, each one no later than the one after it.
+	var search func(node string, until time.Time, hops int) ([]Edge, error)
+	search = func(node string, until time.Time, hops int) ([]Edge, error) {
+		if b, ok := searched[node]; ok && !until.After(b.until) && hops <= b.hops {
+			return nil, nil
+		}
+		if nodes == maxCycleNodes {
+			return nil, errCycleBudget
+		}
+		nodes++
+		filters := Filter{CounterpartyID: node, Type: model.TransferType, Since: &windowStart, Until: &until}
+		count, err := g.repo.Count(ctx, filters)
+		if err != nil {
+			return nil, err
+		}
+		if edges+count > maxCycleEdges {
+			return nil, errCycleBudget
+		}
+		edges += count
+		incoming, err := g.repo.Get(ctx, filters)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range incoming {
+			if t.ID != txn.ID && t.UserID == origin {
+				return []Edge{newEdge(t.toModel())}, nil
+			}
+		}
+		if hops > 1 {
+			for _, t := range incoming {
+				if t.ID == txn.ID || onPath[t.UserID] {
+					continue
+				}
+				onPath[t.UserID] = true
+				path, err := search(t.UserID, t.Timestamp, hops-1)
+				onPath[t.UserID] = false
+				if err != nil || path != nil {
+					return append(path, newEdge(t.toModel())), err
+				}
+			}
+		}
+		searched[node] = bound{until, hops}
+		return nil, nil
+	}
+
+	path, err := search(txn.UserID, txn.Timestamp, maxHops-1)
+	if errors.Is(err, errCycleBudget) {
+		log.Printf("Transfer Graph: Gave up looking for a cycle closed by Tx ID %s after %d users and %d transfers", txn.ID, nodes, edges)
+		return nil, nil
+	}
+	if err != nil || path == nil {
+		return nil, err
+	}
+	return append(path, newEdge(txn)), nil
+}
+
+// Neighborhood returns the transfers between since and until within hops of userID, in either
+// direction, for investigators to see who a user moves money with.
+func (g *TransferGraph) Neighborhood(ctx context.Context, userID string, since, until time.Time, hops int) (Graph, error) {
+	graph := Graph{Nodes: []string{userID}, Edges: []Edge{}}
+	seenNodes := map[string]bool{userID: true}
+	seenEdges := make(map[string]bool)
+
+	frontier := []string{userID}
+	for hop := 0; hop < hops && len(frontier) > 0 && !graph.Truncated; hop++ {
+		var next []string
+		for _, node := range frontier {
+			if graph.Truncated {
+				break
+			}
+			for _, filters := range []Filter{
+				{UserID: node, Type: model.TransferType, Since: &since, Until: &until},
+				{CounterpartyID: node, Type: model.TransferType, Since: &since, Until: &until},
+			} {
+				if graph.Truncated {
+					break
+				}
+				transfers, err := g.repo.Get(ctx, filters)
+				if err != nil {
+					return Graph{}, err
+				}
+				for _, t := range transfers {
+					if t.CounterpartyID == "" || seenEdges[t.ID] {
+						continue
+					}
+					if len(graph.Edges) == maxGraphEdges {
+						graph.Truncated = true
+						break
+					}
+					seenEdges[t.ID] = true
+					graph.Edges = append(graph.Edges, newEdge(t.toModel()))
+					for _, neighbor := range []string{t.UserID, t.CounterpartyID} {
+						if !seenNodes[neighbor] {
+							seenNodes[neighbor] = true
+							graph.Nodes = append(graph.Nodes, neighbor)
+							next = append(next, neighbor)
+						}
+					}
+				}
+			}
+		}
+		frontier = next
+	}
+	slices.SortStableFunc(graph.Edges, func(a, b Edge) int { return a.Timestamp.Compare(b.Timestamp) })
+	return graph, nil
+}
+
+func newEdge(txn model.Transaction) Edge {
+	return Edge{
+		TransactionID:      txn.ID,
+		From:               txn.UserID,
+		To:                 txn.CounterpartyID,
+		Amount:             txn.Amount,
+		Timestamp:          txn.Timestamp,
+		SourceAccount:      txn.SourceAccount,
+		DestinationAccount: txn.DestinationAccount,
+	}
+}
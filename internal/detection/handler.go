@@ -38,9 +38,38 @@ func (h *Handler) GetTransactions(c echo.Context) error {
 		isSuspiciousPtr = &parsedBool
 	}
 
+	status := AnalysisStatus(c.QueryParam("status"))
+	switch status {
+	case "", StatusPending, StatusAnalyzing, StatusAnalyzed, StatusFailed:
+	default:
+		log.Printf("Handler: Invalid value for 'status' query parameter: %q", status)
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid value for query parameter 'status': %s", status))
+	}
+
+	var minRiskScorePtr *float64
+	if minRiskScoreParam := c.QueryParam("min_risk_score"); minRiskScoreParam != "" {
+		parsedScore, err := strconv.ParseFloat(minRiskScoreParam, 64)
+		if err != nil || parsedScore < 0 || parsedScore > maxRiskScore {
+			log.Printf("Handler: Invalid value for 'min_risk_score' query parameter: %q", minRiskScoreParam)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid value for query parameter 'min_risk_score', must be between 0 and 100: %s", minRiskScoreParam))
+		}
+		minRiskScorePtr = &parsedScore
+	}
+
+	riskBand := RiskBand(c.QueryParam("risk_band"))
+	switch riskBand {
+	case "", RiskLow, RiskMedium, RiskHigh:
+	default:
+		log.Printf("Handler: Invalid value for 'risk_band' query parameter: %q", riskBand)
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid value for query parameter 'risk_band': %s", riskBand))
+	}
+
 	filter := Filter{
-		UserID:       userID,
-		IsSuspicious: isSuspiciousPtr,
+		UserID:         userID,
+		IsSuspicious:   isSuspiciousPtr,
+		AnalysisStatus: status,
+		MinRiskScore:   minRiskScorePtr,
+		RiskBand:       riskBand,
 	}
 
 	txns, err := h.repo.Get(ctx, filter)
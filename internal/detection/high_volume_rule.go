@@ -1,25 +1,34 @@
 package detection
 
 import (
+	"fmt"
+
 	"github.com/jasimvs/sample-go-svc/internal/model"
 )
 
 const highVolumeRuleName = "HighVolumeTransaction"
-const amountThreshold = 10000
 
 type HighVolumeRule struct {
 	amountThreshold float64
+	weight          float64
 }
 
-func NewHighVolumeRule() *HighVolumeRule {
+func NewHighVolumeRule(amountThreshold, weight float64) *HighVolumeRule {
 	return &HighVolumeRule{
-		amountThreshold: amountThreshold, // todo make it configurable
+		amountThreshold: amountThreshold,
+		weight:          weight,
 	}
 }
 
-func (r *HighVolumeRule) DetectSuspiciousActivity(txn model.Transaction) (suspicious bool, flaggedRules string, err error) {
+func (r *HighVolumeRule) Name() string {
+	return highVolumeRuleName
+}
+
+func (r *HighVolumeRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
 	if txn.Amount > r.amountThreshold {
-		return true, highVolumeRuleName, nil
+		reason := fmt.Sprintf("amount %.2f is above %.2f", txn.Amount, r.amountThreshold)
+		evidence := &Evidence{Threshold: r.amountThreshold, Observed: txn.Amount, RelatedTransactionIDs: []string{txn.ID}}
+		return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
 	}
-	return false, "", nil
+	return Result{}, nil
 }
@@ -4,77 +4,166 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jasimvs/sample-go-svc/internal/model"
 )
 
+// AnalysisStatus tracks where a transaction is in the detection lifecycle.
+type AnalysisStatus string
+
+const (
+	StatusPending   AnalysisStatus = "PENDING"   // Saved, not yet picked up by the Manager
+	StatusAnalyzing AnalysisStatus = "ANALYZING" // Rules are being evaluated
+	StatusAnalyzed  AnalysisStatus = "ANALYZED"  // Verdict stored, suspicious or clean
+	StatusFailed    AnalysisStatus = "FAILED"    // Last attempt failed, will be retried from the outbox
+)
+
 type Transaction struct {
-	ID           string    `json:"id" db:"id"`
-	UserID       string    `json:"user_id" db:"user_id"`
-	Amount       float64   `json:"amount" db:"amount"`
-	Type         string    `json:"type" db:"type"`
-	Timestamp    time.Time `json:"timestamp" db:"timestamp"`
-	IsSuspicious bool      `json:"is_suspicious" db:"is_suspicious"`
-	FlaggedRules []string  `json:"flagged_rules" db:"flagged_rules"`
+	ID             string         `json:"id" db:"id"`
+	UserID         string         `json:"user_id" db:"user_id"`
+	Amount         float64        `json:"amount" db:"amount"`
+	Type           string         `json:"type" db:"type"`
+	Timestamp      time.Time      `json:"timestamp" db:"timestamp"`
+	IsSuspicious   bool           `json:"is_suspicious" db:"is_suspicious"`
+	FlaggedRules   []string       `json:"flagged_rules" db:"flagged_rules"`
+	AnalysisStatus AnalysisStatus `json:"analysis_status" db:"analysis_status"`
+	AnalyzedAt     *time.Time     `json:"analyzed_at,omitempty" db:"analyzed_at"`
+	RiskScore      float64        `json:"risk_score" db:"risk_score"`
+	RiskBand       RiskBand       `json:"risk_band,omitempty" db:"risk_band"`
+	RiskFactors    []RiskFactor   `json:"risk_factors" db:"risk_factors"`
+	RulesVersion   string         `json:"rules_version,omitempty" db:"rules_version"` // Rule set that produced the verdict
+
+	SourceAccount      string         `json:"source_account,omitempty" db:"source_account"`
+	DestinationAccount string         `json:"destination_account,omitempty" db:"destination_account"`
+	CounterpartyID     string         `json:"counterparty_id,omitempty" db:"counterparty_id"`
+	CounterpartyName   string         `json:"counterparty_name,omitempty" db:"counterparty_name"`
+	Channel            string         `json:"channel,omitempty" db:"channel"`
+	Metadata           map[string]any `json:"metadata,omitempty" db:"metadata"`
+}
+
+// fromModel is txn without a verdict.
+func fromModel(txn model.Transaction) Transaction {
+	return Transaction{
+		ID:                 txn.ID,
+		UserID:             txn.UserID,
+		Amount:             txn.Amount,
+		Type:               txn.Type,
+		Timestamp:          txn.Timestamp,
+		SourceAccount:      txn.SourceAccount,
+		DestinationAccount: txn.DestinationAccount,
+		CounterpartyID:     txn.CounterpartyID,
+		CounterpartyName:   txn.CounterpartyName,
+		Channel:            txn.Channel,
+		Metadata:           txn.Metadata,
+	}
+}
+
+// toModel is the transaction as the rules see it, without its verdict.
+func (t Transaction) toModel() model.Transaction {
+	return model.Transaction{
+		ID:                 t.ID,
+		UserID:             t.UserID,
+		Amount:             t.Amount,
+		Type:               t.Type,
+		Timestamp:          t.Timestamp,
+		SourceAccount:      t.SourceAccount,
+		DestinationAccount: t.DestinationAccount,
+		CounterpartyID:     t.CounterpartyID,
+		CounterpartyName:   t.CounterpartyName,
+		Channel:            t.Channel,
+		Metadata:           t.Metadata,
+	}
 }
 
+// Rule evaluates txn as of txn.Timestamp: windows end at the transaction and never count later
+// transactions, so the verdict does not depend on when, or how late, the transaction is processed.
 type Rule interface {
-	DetectSuspiciousActivity(txn model.Transaction) (bool, string, error)
+	Name() string
+	DetectSuspiciousActivity(txn model.Transaction) (Result, error)
 }
 
 type DetectionRepository interface {
 	Get(ctx context.Context, filters Filter) ([]Transaction, error)
-	UpdateSuspicionStatus(ctx context.Context, transactionID string, isSuspicious bool, flaggedRules []string) error
+	UpdateSuspicionStatus(ctx context.Context, transactionID string, assessment Assessment) error
+	UpdateAnalysisStatus(ctx context.Context, transactionID string, status AnalysisStatus) error
+}
+
+// ruleSet is swapped as a whole, so a transaction is always evaluated against a single version.
+type ruleSet struct {
+	version string
+	rules   []Rule
+	bands   RiskBands
 }
 
 type Manager struct {
-	transactionChannel <-chan model.Transaction
-	rules              []Rule
-	repo               Repository
+	rules atomic.Pointer[ruleSet]
+	repo  Repository
+
+	// One queue per worker; a user's transactions always go to the same queue, see Submit.
+	queues           []chan job
+	workers          sync.WaitGroup
+	processCtx       context.Context
+	cancelProcessing context.CancelFunc
+	submitMu         sync.RWMutex // Held by Submit while sending, so Stop can close the queues safely
+	stopCh           chan struct{}
+	stopping         atomic.Bool // Set by the first Stop, so later calls return ErrManagerStopped
+	stopped          bool
+	abandon          atomic.Bool // Set when Stop's deadline passes; workers then skip what is left
+	abandoned        atomic.Int64
 }
 
-func NewManager(transactionChannel <-chan model.Transaction, repo Repository, rules ...Rule) *Manager {
-	return &Manager{
-		transactionChannel: transactionChannel,
-		rules:              rules,
-		repo:               repo,
+func NewManager(repo Repository, rules ...Rule) *Manager {
+	m := &Manager{
+		repo: repo,
 	}
+	m.rules.Store(&ruleSet{rules: rules, bands: DefaultRiskBands})
+	return m
+}
+
+// SetRules atomically replaces the rule set used for transactions evaluated from now on. Transactions
+// already being evaluated finish with the previous set.
+func (m *Manager) SetRules(version string, rules []Rule, bands RiskBands) {
+	previous := m.rules.Swap(&ruleSet{version: version, rules: rules, bands: bands})
+	log.Printf("Detection Manager: Rule set updated from version %q (%d rules) to %q (%d rules)", previous.version, len(previous.rules), version, len(rules))
 }
 
-func (m *Manager) RunInBackground() {
-	go func() {
-		// todo handle clean exit
-		for txn := range m.transactionChannel {
-			suspicious, flaggedRules, err := m.DetectSuspiciousActivity(txn)
-			if err != nil {
-				log.Printf("Detection Manager: Error detecting suspicious activity for Tx ID %s: %v", txn.ID, err)
-				// todo send to retry queue or dead letter queue
-				continue
-			}
-
-			if suspicious {
-				log.Printf("Detection Manager: Updating suspicion status for Tx ID %s (Suspicious: %t, Rules: %v)", txn.ID, suspicious, flaggedRules)
-				err := m.repo.UpdateSuspicionStatus(context.Background(), txn.ID, suspicious, flaggedRules)
-				if err != nil {
-					log.Printf("failed to update suspicion status for Tx ID %s: %v", txn.ID, err)
-				}
-			}
-			fmt.Println(suspicious, flaggedRules)
-		}
-	}()
+// RulesVersion returns the version of the rule set currently in use.
+func (m *Manager) RulesVersion() string {
+	return m.rules.Load().version
+}
+
+// Process scores txn against all rules and stores the assessment, moving the transaction through
+// ANALYZING to either ANALYZED or FAILED.
+func (m *Manager) Process(ctx context.Context, txn model.Transaction) error {
+	if err := m.repo.UpdateAnalysisStatus(ctx, txn.ID, StatusAnalyzing); err != nil {
+		return fmt.Errorf("failed to mark Tx ID %s as analyzing: %w", txn.ID, err)
+	}
+	if observer, ok := m.repo.(transactionObserver); ok {
+		observer.Observe(txn)
+	}
+
+	assessment, err := m.Assess(txn)
+	if err != nil {
+		m.markFailed(ctx, txn.ID)
+		return fmt.Errorf("error detecting suspicious activity for Tx ID %s: %w", txn.ID, err)
+	}
+
+	if assessment.IsSuspicious {
+		log.Printf("Detection Manager: Updating suspicion status for Tx ID %s (Suspicious: %t, Rules: %v)", txn.ID, assessment.IsSuspicious, assessment.FlaggedRules)
+	}
+	err = m.repo.UpdateSuspicionStatus(ctx, txn.ID, assessment)
+	if err != nil {
+		m.markFailed(ctx, txn.ID)
+		return fmt.Errorf("failed to update suspicion status for Tx ID %s: %w", txn.ID, err)
+	}
+	return nil
 }
 
-func (m *Manager) DetectSuspiciousActivity(txn model.Transaction) (suspicious bool, flaggedRules []string, err error) {
-	for _, proc := range m.rules {
-		s, f, err := proc.DetectSuspiciousActivity(txn)
-		if err != nil {
-			return false, nil, err
-		}
-		if s {
-			suspicious = true
-			flaggedRules = append(flaggedRules, f)
-		}
+func (m *Manager) markFailed(ctx context.Context, transactionID string) {
+	if err := m.repo.UpdateAnalysisStatus(ctx, transactionID, StatusFailed); err != nil {
+		log.Printf("Detection Manager: Failed to mark Tx ID %s as failed: %v", transactionID, err)
 	}
-	return suspicious, flaggedRules, nil
 }
@@ -0,0 +1,128 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+const networkFanRuleName = "NetworkFan"
+
+// NetworkFanRule flags transfers that are part of a money mule pattern within the window: fan-out,
+// a user sending to more than maxRecipients new counterparties, or fan-in, more than maxSenders users
+// sending to the transfer's counterparty. A recipient the user already sent to in the history period
+// before the window is not new; with a zero history every recipient counts. A zero limit turns its
+// direction off.
+type NetworkFanRule struct {
+	repo           Repository
+	windowDuration time.Duration
+	history        time.Duration
+	maxRecipients  int
+	maxSenders     int
+	weight         float64
+}
+
+func NewNetworkFanRule(repo Repository, windowDuration, history time.Duration, maxRecipients, maxSenders int, weight float64) *NetworkFanRule {
+	if repo == nil {
+		panic("Repository cannot be nil for NetworkFanRule")
+	}
+	return &NetworkFanRule{
+		repo:           repo,
+		windowDuration: windowDuration,
+		history:        history,
+		maxRecipients:  maxRecipients,
+		maxSenders:     maxSenders,
+		weight:         weight,
+	}
+}
+
+func (r *NetworkFanRule) Name() string {
+	return networkFanRuleName
+}
+
+func (r *NetworkFanRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	if txn.Type != model.TransferType || txn.CounterpartyID == "" {
+		return Result{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	windowStart := txn.Timestamp.Add(-r.windowDuration)
+	var reasons []string
+	var evidence *Evidence
+
+	if r.maxRecipients > 0 {
+		filters := Filter{UserID: txn.UserID, Type: model.TransferType, Since: &windowStart, Until: &txn.Timestamp}
+		recipients, err := r.newRecipients(ctx, filters)
+		if err != nil {
+			return Result{}, err
+		}
+		if len(recipients) > r.maxRecipients {
+			reasons = append(reasons, fmt.Sprintf("sent to %d new counterparties, more than %d: %s", len(recipients), r.maxRecipients, summarizeIDs(recipients)))
+			recipient := func(t Transaction) string { return t.CounterpartyID }
+			if evidence, err = r.evidence(ctx, filters, r.maxRecipients, recipients, recipient); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+	if r.maxSenders > 0 {
+		filters := Filter{CounterpartyID: txn.CounterpartyID, Type: model.TransferType, Since: &windowStart, Until: &txn.Timestamp}
+		senders, err := r.repo.Distinct(ctx, filters, FieldUserID)
+		if err != nil {
+			return Result{}, err
+		}
+		if len(senders) > r.maxSenders {
+			reasons = append(reasons, fmt.Sprintf("%s received from %d users, more than %d: %s", txn.CounterpartyID, len(senders), r.maxSenders, summarizeIDs(senders)))
+			if evidence == nil {
+				sender := func(t Transaction) string { return t.UserID }
+				if evidence, err = r.evidence(ctx, filters, r.maxSenders, senders, sender); err != nil {
+					return Result{}, err
+				}
+			}
+		}
+	}
+	if evidence == nil {
+		return Result{}, nil
+	}
+
+	reason := fmt.Sprintf("within %s %s", r.windowDuration, strings.Join(reasons, "; "))
+	return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
+}
+
+// newRecipients lists the counterparties of the transfers matching filters that the user did not send
+// to in the history period before them.
+func (r *NetworkFanRule) newRecipients(ctx context.Context, filters Filter) ([]string, error) {
+	recipients, err := r.repo.Distinct(ctx, filters, FieldCounterpartyID)
+	if err != nil || r.history == 0 || len(recipients) <= r.maxRecipients {
+		return recipients, err
+	}
+
+	historyStart := filters.Since.Add(-r.history)
+	known, err := r.repo.Distinct(ctx, Filter{UserID: filters.UserID, Type: filters.Type, Since: &historyStart, Before: filters.Since}, FieldCounterpartyID)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(recipients, func(id string) bool { return slices.Contains(known, id) }), nil
+}
+
+// evidence lists the transfers matching filters with one of counterparties on the other side, as
+// told by side. They are only loaded once the rule matched.
+func (r *NetworkFanRule) evidence(ctx context.Context, filters Filter, limit int, counterparties []string, side func(Transaction) string) (*Evidence, error) {
+	transfers, err := r.repo.Get(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	transfers = slices.DeleteFunc(transfers, func(t Transaction) bool { return !slices.Contains(counterparties, side(t)) })
+	return &Evidence{
+		Threshold:             float64(limit),
+		Observed:              float64(len(counterparties)),
+		Window:                r.windowDuration.String(),
+		RelatedTransactionIDs: transactionIDs(transfers),
+		Counterparties:        counterparties,
+	}, nil
+}
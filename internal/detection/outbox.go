@@ -0,0 +1,205 @@
+package detection
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+// OutboxEntry is a claimed row of the transaction_outbox table along with the transaction it refers to.
+type OutboxEntry struct {
+	ID          int64
+	Attempts    int
+	Transaction model.Transaction
+}
+
+type OutboxRepository interface {
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]OutboxEntry, error)
+	MarkDone(ctx context.Context, entryID int64) error
+	Enqueue(ctx context.Context, transactionID string) error
+	EnqueueStale(ctx context.Context, olderThan time.Time) (int, error)
+	Retry(ctx context.Context, entryID int64, notBefore time.Time) error
+	Release(ctx context.Context, entryID int64) error
+	DeadLetter(ctx context.Context, entryID int64, deadLetter DeadLetter) error
+}
+
+type sqliteOutboxRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteOutboxRepository(db *sql.DB) OutboxRepository {
+	if db == nil {
+		panic("database connection (*sql.DB) is required for NewSQLiteOutboxRepository")
+	}
+	return &sqliteOutboxRepository{db: db}
+}
+
+// Claim leases up to limit unprocessed entries, oldest first. Entries whose lease has expired are
+// claimable again, which is how work abandoned by a crashed or failed relay gets picked up.
+func (r *sqliteOutboxRepository) Claim(ctx context.Context, limit int, lease time.Duration) (entries []OutboxEntry, err error) {
+	sqlTx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin outbox claim: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = sqlTx.Rollback()
+		}
+	}()
+
+	now := time.Now().UTC()
+	query := `
+    SELECT o.id, o.attempts, t.id, t.user_id, t.amount, t.type, t.timestamp, ` + detailColumns + `
+    FROM transaction_outbox o JOIN transactions t ON t.id = o.transaction_id
+    WHERE o.processed_at IS NULL AND (o.claimed_until IS NULL OR o.claimed_until < ?)
+    ORDER BY o.id
+    LIMIT ?`
+	rows, err := sqlTx.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox entries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e OutboxEntry
+		tx := &e.Transaction
+		var details transactionDetails
+		if err = rows.Scan(append([]any{&e.ID, &e.Attempts, &tx.ID, &tx.UserID, &tx.Amount, &tx.Type, &tx.Timestamp}, details.targets()...)...); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox row: %w", err)
+		}
+		if err = details.apply(tx); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating outbox rows: %w", err)
+	}
+	if len(entries) == 0 {
+		err = sqlTx.Commit()
+		return nil, err
+	}
+
+	placeholders := make([]string, len(entries))
+	args := []any{now.Add(lease)}
+	for i := range entries {
+		placeholders[i] = "?"
+		args = append(args, entries[i].ID)
+		entries[i].Attempts++
+	}
+	update := `UPDATE transaction_outbox SET claimed_until = ?, attempts = attempts + 1 WHERE id IN (` + strings.Join(placeholders, ",") + `)`
+	if _, err = sqlTx.ExecContext(ctx, update, args...); err != nil {
+		return nil, fmt.Errorf("failed to claim outbox entries: %w", err)
+	}
+
+	if err = sqlTx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit outbox claim: %w", err)
+	}
+	return entries, nil
+}
+
+func (r *sqliteOutboxRepository) MarkDone(ctx context.Context, entryID int64) error {
+	query := `UPDATE transaction_outbox SET processed_at = ?, claimed_until = NULL WHERE id = ?`
+	result, err := r.db.ExecContext(ctx, query, time.Now().UTC(), entryID)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox entry %d as done: %w", entryID, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected for outbox entry %d: %w", entryID, err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: no outbox entry found with id %d", ErrUpdateFailed, entryID)
+	}
+	return nil
+}
+
+// Retry hides a failed entry from Claim until notBefore, which is how retry backoff is applied.
+func (r *sqliteOutboxRepository) Retry(ctx context.Context, entryID int64, notBefore time.Time) error {
+	query := `UPDATE transaction_outbox SET claimed_until = ? WHERE id = ? AND processed_at IS NULL`
+	result, err := r.db.ExecContext(ctx, query, notBefore.UTC(), entryID)
+	if err != nil {
+		return fmt.Errorf("failed to schedule retry of outbox entry %d: %w", entryID, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected for outbox entry %d: %w", entryID, err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: no pending outbox entry found with id %d", ErrUpdateFailed, entryID)
+	}
+	return nil
+}
+
+// Release gives up a claim without counting it as an attempt, making the entry claimable right away.
+func (r *sqliteOutboxRepository) Release(ctx context.Context, entryID int64) error {
+	query := `UPDATE transaction_outbox SET claimed_until = NULL, attempts = MAX(attempts - 1, 0) WHERE id = ? AND processed_at IS NULL`
+	if _, err := r.db.ExecContext(ctx, query, entryID); err != nil {
+		return fmt.Errorf("failed to release outbox entry %d: %w", entryID, err)
+	}
+	return nil
+}
+
+// DeadLetter records the failure in dead_letters and finishes the outbox entry in one SQL transaction.
+func (r *sqliteOutboxRepository) DeadLetter(ctx context.Context, entryID int64, deadLetter DeadLetter) (err error) {
+	sqlTx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin dead lettering of outbox entry %d: %w", entryID, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = sqlTx.Rollback()
+		}
+	}()
+
+	now := time.Now().UTC()
+	query := `INSERT INTO dead_letters (transaction_id, rule, error, attempts, created_at) VALUES (?, ?, ?, ?, ?)`
+	_, err = sqlTx.ExecContext(ctx, query, deadLetter.TransactionID, deadLetter.Rule, deadLetter.Error, deadLetter.Attempts, now)
+	if err != nil {
+		return fmt.Errorf("failed to insert dead letter for transaction %s: %w", deadLetter.TransactionID, err)
+	}
+	_, err = sqlTx.ExecContext(ctx, `UPDATE transaction_outbox SET processed_at = ?, claimed_until = NULL WHERE id = ?`, now, entryID)
+	if err != nil {
+		return fmt.Errorf("failed to finish outbox entry %d: %w", entryID, err)
+	}
+
+	if err = sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit dead lettering of outbox entry %d: %w", entryID, err)
+	}
+	return nil
+}
+
+// Enqueue adds an outbox entry for an already saved transaction.
+func (r *sqliteOutboxRepository) Enqueue(ctx context.Context, transactionID string) error {
+	query := `INSERT INTO transaction_outbox (transaction_id, created_at) VALUES (?, ?)`
+	if _, err := r.db.ExecContext(ctx, query, transactionID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to enqueue transaction %s: %w", transactionID, err)
+	}
+	return nil
+}
+
+// EnqueueStale adds an outbox entry for every transaction that has been PENDING or ANALYZING since
+// before olderThan and has no unfinished outbox entry, e.g. rows that predate the outbox or whose
+// entry was marked done without the verdict being stored.
+func (r *sqliteOutboxRepository) EnqueueStale(ctx context.Context, olderThan time.Time) (int, error) {
+	query := `
+    INSERT INTO transaction_outbox (transaction_id, created_at)
+    SELECT t.id, ? FROM transactions t
+    WHERE t.analysis_status IN (?, ?)
+      AND COALESCE(t.status_updated_at, t.timestamp) < ?
+      AND NOT EXISTS (SELECT 1 FROM transaction_outbox o WHERE o.transaction_id = t.id AND o.processed_at IS NULL)
+    ORDER BY t.timestamp`
+	result, err := r.db.ExecContext(ctx, query, time.Now().UTC(), StatusPending, StatusAnalyzing, olderThan.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to enqueue stale transactions: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected for stale transactions: %w", err)
+	}
+	return int(rowsAffected), nil
+}
@@ -0,0 +1,213 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// UserProfile is a user's normal behaviour over a lookback period, the baseline AnomalyRule compares
+// a transaction with.
+type UserProfile struct {
+	Transactions int
+	Types        map[string]AmountProfile // By transaction type
+	HourShare    [24]float64              // Share of the transactions in each UTC hour of the day, 0-1
+	DailyMean    float64                  // Transactions per day, days without any included
+	DailyStdDev  float64
+}
+
+// AmountProfile is the amount distribution of one transaction type.
+type AmountProfile struct {
+	Count  int
+	Mean   float64
+	StdDev float64
+}
+
+// Profile summarizes the user's transactions in [since, before), computed from the stored transactions.
+// The WindowStore keeps profiles up to date in memory instead, see WindowStore.Profile, and falls back
+// to this for the periods it cannot answer.
+func (r *sqliteRepository) Profile(ctx context.Context, userID string, since, before time.Time) (UserProfile, error) {
+	profile := UserProfile{Types: make(map[string]AmountProfile)}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT type, COUNT(*), AVG(amount), AVG(amount * amount) FROM transactions
+        WHERE user_id = ? AND timestamp >= ? AND timestamp < ? GROUP BY type`, userID, since, before)
+	if err != nil {
+		return UserProfile{}, fmt.Errorf("failed to query amount profile of user %s: %w", userID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var txnType string
+		var amounts AmountProfile
+		var meanOfSquares float64
+		if err := rows.Scan(&txnType, &amounts.Count, &amounts.Mean, &meanOfSquares); err != nil {
+			return UserProfile{}, fmt.Errorf("failed to scan amount profile row: %w", err)
+		}
+		amounts.StdDev = math.Sqrt(max(meanOfSquares-amounts.Mean*amounts.Mean, 0))
+		profile.Types[txnType] = amounts
+		profile.Transactions += amounts.Count
+	}
+	if err := rows.Err(); err != nil {
+		return UserProfile{}, fmt.Errorf("error iterating amount profile rows: %w", err)
+	}
+	if profile.Transactions == 0 {
+		return profile, nil
+	}
+
+	hours, err := r.db.QueryContext(ctx, `SELECT CAST(strftime('%H', timestamp) AS INTEGER), COUNT(*) FROM transactions
+        WHERE user_id = ? AND timestamp >= ? AND timestamp < ? GROUP BY 1`, userID, since, before)
+	if err != nil {
+		return UserProfile{}, fmt.Errorf("failed to query hour profile of user %s: %w", userID, err)
+	}
+	defer hours.Close()
+	for hours.Next() {
+		var hour, count int
+		if err := hours.Scan(&hour, &count); err != nil {
+			return UserProfile{}, fmt.Errorf("failed to scan hour profile row: %w", err)
+		}
+		profile.HourShare[hour] = float64(count) / float64(profile.Transactions)
+	}
+	if err := hours.Err(); err != nil {
+		return UserProfile{}, fmt.Errorf("error iterating hour profile rows: %w", err)
+	}
+
+	days, err := r.AggregateByBucket(ctx, Filter{UserID: userID, Since: &since, Before: &before}, 24*time.Hour)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	profile.DailyMean, profile.DailyStdDev = dailyFrequency(days, before.Sub(since))
+	return profile, nil
+}
+
+// dailyFrequency is the mean and standard deviation of the daily counts over period, counting the days
+// without a bucket as 0.
+func dailyFrequency(days []Bucket, period time.Duration) (mean, stdDev float64) {
+	n := math.Max(math.Round(period.Hours()/24), 1)
+	var sum, sumOfSquares float64
+	for _, day := range days {
+		sum += float64(day.Count)
+		sumOfSquares += float64(day.Count * day.Count)
+	}
+	mean = sum / n
+	return mean, math.Sqrt(max(sumOfSquares/n-mean*mean, 0))
+}
+
+// rollingProfile is a user's UserProfile over a period of fixed length that only moves forward, so it
+// is kept up to date by adding the transactions that come into the period and removing the ones that
+// drop out of it, instead of being recomputed.
+type rollingProfile struct {
+	period  time.Duration
+	before  time.Time      // End of the profiled period, exclusive
+	entries []profileEntry // From the start of the profiled period on, oldest first
+	counted int            // entries[:counted] are before the end, and in the sums below
+	types   map[string]amountSums
+	hours   [24]int
+	days    map[int64]int // By epoch-aligned UTC day, like AggregateByBucket
+}
+
+type profileEntry struct {
+	id        string
+	txnType   string
+	amount    float64
+	timestamp time.Time
+}
+
+type amountSums struct {
+	count           int
+	sum, sumSquares float64
+}
+
+// newRollingProfile starts an empty profile ending at since, from the user's transactions since then,
+// newest first as Get returns them. Move it to the period wanted with advance.
+func newRollingProfile(period time.Duration, since time.Time, txns []Transaction) *rollingProfile {
+	p := &rollingProfile{
+		period:  period,
+		before:  since,
+		entries: make([]profileEntry, 0, len(txns)),
+		types:   make(map[string]amountSums),
+		days:    make(map[int64]int),
+	}
+	for i := len(txns) - 1; i >= 0; i-- {
+		p.entries = append(p.entries, profileEntry{id: txns[i].ID, txnType: txns[i].Type, amount: txns[i].Amount, timestamp: txns[i].Timestamp})
+	}
+	return p
+}
+
+// advance moves the end of the profiled period forward to before.
+func (p *rollingProfile) advance(before time.Time) {
+	for p.counted < len(p.entries) && p.entries[p.counted].timestamp.Before(before) {
+		p.count(p.entries[p.counted], 1)
+		p.counted++
+	}
+	since := before.Add(-p.period)
+	dropped := 0
+	for dropped < p.counted && p.entries[dropped].timestamp.Before(since) {
+		p.count(p.entries[dropped], -1)
+		dropped++
+	}
+	p.entries = p.entries[dropped:]
+	p.counted -= dropped
+	p.before = before
+}
+
+// observe adds a transaction. Adding one twice, e.g. on a retry, keeps one copy, and transactions from
+// before the profiled period are ignored.
+func (p *rollingProfile) observe(entry profileEntry) {
+	if entry.timestamp.Before(p.before.Add(-p.period)) {
+		return
+	}
+	i := sort.Search(len(p.entries), func(i int) bool { return p.entries[i].timestamp.After(entry.timestamp) })
+	for j := i - 1; j >= 0 && p.entries[j].timestamp.Equal(entry.timestamp); j-- {
+		if p.entries[j].id == entry.id {
+			return
+		}
+	}
+	p.entries = append(p.entries, profileEntry{})
+	copy(p.entries[i+1:], p.entries[i:])
+	p.entries[i] = entry
+	if entry.timestamp.Before(p.before) {
+		p.count(entry, 1)
+		p.counted++
+	}
+}
+
+// count adds entry to the sums, or removes it with a sign of -1.
+func (p *rollingProfile) count(entry profileEntry, sign int) {
+	sums := p.types[entry.txnType]
+	sums.count += sign
+	sums.sum += float64(sign) * entry.amount
+	sums.sumSquares += float64(sign) * entry.amount * entry.amount
+	if sums.count == 0 {
+		delete(p.types, entry.txnType)
+	} else {
+		p.types[entry.txnType] = sums
+	}
+	p.hours[entry.timestamp.UTC().Hour()] += sign
+	day := entry.timestamp.Unix() / int64(24*time.Hour/time.Second)
+	if p.days[day] += sign; p.days[day] == 0 {
+		delete(p.days, day)
+	}
+}
+
+func (p *rollingProfile) profile() UserProfile {
+	profile := UserProfile{Types: make(map[string]AmountProfile, len(p.types))}
+	for txnType, sums := range p.types {
+		n := float64(sums.count)
+		mean := sums.sum / n
+		profile.Types[txnType] = AmountProfile{Count: sums.count, Mean: mean, StdDev: math.Sqrt(max(sums.sumSquares/n-mean*mean, 0))}
+		profile.Transactions += sums.count
+	}
+	if profile.Transactions == 0 {
+		return profile
+	}
+	for hour, count := range p.hours {
+		profile.HourShare[hour] = float64(count) / float64(profile.Transactions)
+	}
+	days := make([]Bucket, 0, len(p.days))
+	for _, count := range p.days {
+		days = append(days, Bucket{Count: count})
+	}
+	profile.DailyMean, profile.DailyStdDev = dailyFrequency(days, p.period)
+	return profile
+}
@@ -2,6 +2,7 @@ package detection
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/jasimvs/sample-go-svc/internal/model"
@@ -13,40 +14,89 @@ type RapidTransfersRule struct {
 	repo           Repository
 	minConsecutive int
 	windowDuration time.Duration
+	consecutive    bool // Whether the transfers must follow each other, or may be interleaved with other types
+	weight         float64
 }
 
-func NewRapidTransfersRule(repo Repository, minConsecutive int, windowDuration time.Duration) *RapidTransfersRule {
+func NewRapidTransfersRule(repo Repository, minConsecutive int, windowDuration time.Duration, consecutive bool, weight float64) *RapidTransfersRule {
 	return &RapidTransfersRule{
 		repo:           repo,
 		minConsecutive: minConsecutive,
 		windowDuration: windowDuration,
+		consecutive:    consecutive,
+		weight:         weight,
 	}
 }
 
-func (r *RapidTransfersRule) DetectSuspiciousActivity(txn model.Transaction) (bool, string, error) {
+func (r *RapidTransfersRule) Name() string {
+	return rapidTransfersRuleName
+}
+
+func (r *RapidTransfersRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
 	if txn.Type != model.TransferType {
-		return false, "", nil
+		return Result{}, nil
 	}
 
 	windowStart := txn.Timestamp.Add(-r.windowDuration)
 
 	filters := Filter{
 		UserID: txn.UserID,
-		Since:  &windowStart,
 		Type:   model.TransferType,
+		Since:  &windowStart,
+		Until:  &txn.Timestamp,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Too few transfers in the window, consecutive or not, needs no rows loaded.
+	transfers, err := r.repo.Count(ctx, filters)
+	if err != nil {
+		return Result{}, err
+	}
+	if transfers < r.minConsecutive {
+		return Result{}, nil
+	}
+
+	if r.consecutive {
+		filters.Type = "" // Other types break the sequence, so they are needed too
+	}
 	recentTxns, err := r.repo.Get(ctx, filters)
 	if err != nil {
-		return false, "", err
+		return Result{}, err
+	}
+
+	// Newest first, so the run of transfers ending at txn is a prefix.
+	sequence := recentTxns
+	if r.consecutive {
+		sequence = transferRun(recentTxns)
 	}
 
-	if len(recentTxns) >= r.minConsecutive {
-		return true, rapidTransfersRuleName, nil
+	if len(sequence) >= r.minConsecutive {
+		ids := transactionIDs(sequence)
+		kind := "transfers"
+		if r.consecutive {
+			kind = "consecutive transfers"
+		}
+		reason := fmt.Sprintf("%d %s within %s, at least %d: %s", len(sequence), kind, r.windowDuration, r.minConsecutive, summarizeIDs(ids))
+		evidence := &Evidence{
+			Threshold:             float64(r.minConsecutive),
+			Observed:              float64(len(sequence)),
+			Window:                r.windowDuration.String(),
+			RelatedTransactionIDs: ids,
+		}
+		return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
 	}
 
-	return false, "", nil
+	return Result{}, nil
+}
+
+// transferRun returns the transfers at the start of txns, up to the first transaction of another type.
+func transferRun(txns []Transaction) []Transaction {
+	for i, txn := range txns {
+		if txn.Type != model.TransferType {
+			return txns[:i]
+		}
+	}
+	return txns
 }
@@ -0,0 +1,238 @@
+package detection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+// Relay moves work from the transactional outbox into the detection Manager. An entry is only
+// marked done after the Manager has processed it, so delivery is at-least-once across restarts.
+// It also feeds the Manager from the non-transactional publishers, see Consume and ProcessBatch.
+type Relay struct {
+	outbox       OutboxRepository
+	manager      *Manager
+	pollInterval time.Duration
+	batchSize    int
+	lease        time.Duration
+	retry        RetryPolicy
+	stopped      chan struct{}
+}
+
+func NewRelay(outbox OutboxRepository, manager *Manager, pollInterval time.Duration, batchSize int, lease time.Duration, retry RetryPolicy) *Relay {
+	if outbox == nil || manager == nil {
+		panic("OutboxRepository and Manager are required for NewRelay")
+	}
+	return &Relay{
+		outbox:       outbox,
+		manager:      manager,
+		pollInterval: pollInterval,
+		batchSize:    batchSize,
+		lease:        lease,
+		retry:        retry,
+		stopped:      make(chan struct{}),
+	}
+}
+
+// Recover re-enqueues transactions stuck in PENDING or ANALYZING for longer than lease. It is meant
+// to be called once on boot, before RunInBackground.
+func (r *Relay) Recover(ctx context.Context, lease time.Duration) (int, error) {
+	count, err := r.outbox.EnqueueStale(ctx, time.Now().Add(-lease))
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		log.Printf("Outbox Relay: Re-enqueued %d transactions stuck for longer than %s", count, lease)
+	}
+	return count, nil
+}
+
+// RunInBackground polls the outbox until ctx is cancelled. Use Wait to block until polling has stopped.
+func (r *Relay) RunInBackground(ctx context.Context) {
+	go func() {
+		defer close(r.stopped)
+		ticker := time.NewTicker(r.pollInterval)
+		defer ticker.Stop()
+		for {
+			// Keep draining without waiting for the ticker while there is a backlog.
+			if claimed := r.poll(ctx); claimed == r.batchSize && ctx.Err() == nil {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				log.Println("Outbox Relay: Stopped.")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Wait blocks until the polling goroutine started by RunInBackground has exited, after which no more
+// work is submitted to the Manager.
+func (r *Relay) Wait() {
+	<-r.stopped
+}
+
+// poll claims one batch and hands it to the Manager's workers, returning the number of entries claimed.
+// Entries are acknowledged from the workers once processed, so the lease must cover the time an entry
+// can spend queued.
+func (r *Relay) poll(ctx context.Context) int {
+	entries, err := r.outbox.Claim(ctx, r.batchSize, r.lease)
+	if err != nil {
+		log.Printf("Outbox Relay: Error claiming outbox entries: %v", err)
+		return 0
+	}
+
+	for i, entry := range entries {
+		if err := r.manager.Submit(ctx, entry.Transaction, r.ack(entry)); err != nil {
+			// Typically shutting down: hand the rest of the batch back so it is claimed right away next run.
+			log.Printf("Outbox Relay: Error submitting Tx ID %s, releasing %d claimed entries: %v", entry.Transaction.ID, len(entries)-i, err)
+			for _, unsubmitted := range entries[i:] {
+				r.release(unsubmitted)
+			}
+			break
+		}
+	}
+	return len(entries)
+}
+
+func (r *Relay) release(entry OutboxEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.outbox.Release(ctx, entry.ID); err != nil {
+		// The claim is left to expire, after which the entry is picked up again.
+		log.Printf("Outbox Relay: Error releasing outbox entry %d: %v", entry.ID, err)
+	}
+}
+
+// ack returns the callback that records the outcome of processing entry.
+func (r *Relay) ack(entry OutboxEntry) func(error) {
+	return func(processErr error) {
+		if errors.Is(processErr, ErrManagerStopped) {
+			r.release(entry)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if processErr != nil {
+			log.Printf("Outbox Relay: Error processing Tx ID %s (attempt %d): %v", entry.Transaction.ID, entry.Attempts, processErr)
+			r.handleFailure(ctx, entry, processErr)
+			return
+		}
+		if err := r.outbox.MarkDone(ctx, entry.ID); err != nil {
+			log.Printf("Outbox Relay: Error marking outbox entry %d done for Tx ID %s: %v", entry.ID, entry.Transaction.ID, err)
+		}
+	}
+}
+
+// handleFailure schedules the entry for another attempt with backoff, or moves it to the dead letter
+// table once the retry policy is exhausted. If either write fails, the claim is left to expire and the
+// entry is picked up again after the lease.
+func (r *Relay) handleFailure(ctx context.Context, entry OutboxEntry, processErr error) {
+	if !r.retry.Exhausted(entry.Attempts) {
+		backoff := r.retry.Backoff(entry.Attempts)
+		if err := r.outbox.Retry(ctx, entry.ID, time.Now().Add(backoff)); err != nil {
+			log.Printf("Outbox Relay: Error scheduling retry of outbox entry %d: %v", entry.ID, err)
+		}
+		return
+	}
+
+	deadLetter := DeadLetter{
+		TransactionID: entry.Transaction.ID,
+		Error:         processErr.Error(),
+		Attempts:      entry.Attempts,
+	}
+	var ruleErr *RuleError
+	if errors.As(processErr, &ruleErr) {
+		deadLetter.Rule = ruleErr.Rule
+	}
+	if err := r.outbox.DeadLetter(ctx, entry.ID, deadLetter); err != nil {
+		log.Printf("Outbox Relay: Error dead lettering outbox entry %d: %v", entry.ID, err)
+		return
+	}
+	log.Printf("Outbox Relay: Tx ID %s moved to dead letters after %d attempts", entry.Transaction.ID, entry.Attempts)
+}
+
+// Consume feeds transactions from an in-memory queue into the Manager until ctx is cancelled or the
+// queue is closed. Failed detections are moved to the outbox, to get the same retries and dead
+// lettering as outbox entries.
+func (r *Relay) Consume(ctx context.Context, txns <-chan model.Transaction) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case txn, ok := <-txns:
+			if !ok {
+				return
+			}
+			if err := r.manager.Submit(ctx, txn, r.fallBackToOutbox(txn, nil)); err != nil {
+				// Left PENDING, so boot recovery picks it up.
+				log.Printf("Outbox Relay: Error submitting queued Tx ID %s: %v", txn.ID, err)
+				return
+			}
+		}
+	}
+}
+
+// ProcessBatch processes txns and waits for all of them. Failed detections are moved to the outbox
+// like in Consume. It only returns an error if the batch could not be processed in full because the
+// Manager stopped, in which case the caller should offer the batch again later.
+func (r *Relay) ProcessBatch(ctx context.Context, txns []model.Transaction) error {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stopped int
+	)
+	onStopped := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped++
+	}
+
+	for i, txn := range txns {
+		wg.Add(1)
+		done := r.fallBackToOutbox(txn, onStopped)
+		if err := r.manager.Submit(ctx, txn, func(err error) { done(err); wg.Done() }); err != nil {
+			wg.Done()
+			wg.Wait()
+			return fmt.Errorf("submitted %d of %d transactions: %w", i, len(txns), err)
+		}
+	}
+	wg.Wait()
+
+	if stopped > 0 {
+		return fmt.Errorf("%d of %d transactions not processed: %w", stopped, len(txns), ErrManagerStopped)
+	}
+	return nil
+}
+
+// fallBackToOutbox returns a callback that enqueues txn on the outbox if processing failed. onStopped,
+// if set, is called instead when the Manager stopped before processing txn.
+func (r *Relay) fallBackToOutbox(txn model.Transaction, onStopped func()) func(error) {
+	return func(processErr error) {
+		if processErr == nil {
+			return
+		}
+		if errors.Is(processErr, ErrManagerStopped) {
+			if onStopped != nil {
+				onStopped()
+			}
+			return
+		}
+
+		log.Printf("Outbox Relay: Error processing Tx ID %s, moving it to the outbox: %v", txn.ID, processErr)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.outbox.Enqueue(ctx, txn.ID); err != nil {
+			log.Printf("Outbox Relay: Error moving Tx ID %s to the outbox: %v", txn.ID, err)
+		}
+	}
+}
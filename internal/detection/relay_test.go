@@ -0,0 +1,58 @@
+package detection
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRelay_DeadLetter tests that a failed detection is scheduled for a retry with backoff, and moved to
+// the dead letters with the failing rule once the retry policy is exhausted.
+func TestRelay_DeadLetter(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	outbox := NewSQLiteOutboxRepository(db)
+	deadLetters := NewSQLiteDeadLetterRepository(db)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	insertTestData(t, db, Transaction{ID: "relay_fail", UserID: "u1", Amount: 10, Type: model.DepositType, Timestamp: now})
+	require.NoError(t, outbox.Enqueue(ctx, "relay_fail"))
+
+	// Each round claims the entry and waits for the failure to be handled.
+	retry := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour, MaxBackoff: time.Hour, Multiplier: 2}
+	poll := func(t *testing.T) int {
+		t.Helper()
+		manager := NewManager(repo, failingRule{})
+		manager.Run(ctx, 1, 1)
+		claimed := NewRelay(outbox, manager, time.Second, 10, time.Minute, retry).poll(ctx)
+		_, err := manager.Stop(ctx)
+		require.NoError(t, err)
+		return claimed
+	}
+
+	require.Equal(t, 1, poll(t))
+	assert.Equal(t, 0, poll(t), "The retry should wait for the backoff")
+	listed, err := deadLetters.List(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, listed)
+
+	_, err = db.Exec(`UPDATE transaction_outbox SET claimed_until = ?`, now.Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, poll(t))
+	listed, err = deadLetters.List(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, "relay_fail", listed[0].TransactionID)
+	assert.Equal(t, "Failing", listed[0].Rule)
+	assert.Equal(t, 2, listed[0].Attempts)
+	assert.Contains(t, listed[0].Error, "boom")
+
+	_, err = db.Exec(`UPDATE transaction_outbox SET claimed_until = NULL`)
+	require.NoError(t, err)
+	assert.Equal(t, 0, poll(t), "A dead lettered entry should not be claimed again")
+}
@@ -17,7 +17,7 @@ import (
 )
 
 // setupDetectionTestDB creates a test DB, runs migration, and returns the DB and repo.
-func setupDetectionTestDB(t *testing.T) (db *sql.DB, repo Repository, cleanup func()) {
+func setupDetectionTestDB(t testing.TB) (db *sql.DB, repo Repository, cleanup func()) {
 	t.Helper()
 
 	tempDir := t.TempDir()
@@ -38,16 +38,34 @@ func setupDetectionTestDB(t *testing.T) (db *sql.DB, repo Repository, cleanup fu
     CREATE TABLE IF NOT EXISTS transactions (
         id TEXT PRIMARY KEY, user_id TEXT NOT NULL, amount REAL NOT NULL,
         type TEXT NOT NULL, timestamp TIMESTAMP NOT NULL,
-        is_suspicious INTEGER NOT NULL DEFAULT 0, flagged_rules TEXT
+        is_suspicious INTEGER NOT NULL DEFAULT 0, flagged_rules TEXT,
+        analysis_status TEXT NOT NULL DEFAULT 'PENDING', status_updated_at TIMESTAMP, analyzed_at TIMESTAMP,
+        risk_score REAL NOT NULL DEFAULT 0, risk_band TEXT, risk_factors TEXT, rules_version TEXT,
+        source_account TEXT, destination_account TEXT, counterparty_id TEXT, counterparty_name TEXT, channel TEXT, metadata TEXT
+    );`
+	outboxQuery := `
+    CREATE TABLE IF NOT EXISTS transaction_outbox (
+        id INTEGER PRIMARY KEY AUTOINCREMENT, transaction_id TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL, claimed_until TIMESTAMP,
+        attempts INTEGER NOT NULL DEFAULT 0, processed_at TIMESTAMP
     );`
 	indexQuery := `
     CREATE INDEX IF NOT EXISTS idx_transactions_is_suspicious ON transactions(is_suspicious);
     `
 	_, err = db.Exec(tableQuery)
 	require.NoError(t, err)
+	_, err = db.Exec(outboxQuery)
+	require.NoError(t, err)
 	_, err = db.Exec(indexQuery)
 	require.NoError(t, err)
 
+	err = NewSQLiteDeadLetterRepository(db).Migrate(context.Background())
+	require.NoError(t, err)
+	err = NewSQLiteRuleStatsRepository(db).Migrate(context.Background())
+	require.NoError(t, err)
+	err = NewSQLiteRuleVersionRepository(db).Migrate(context.Background())
+	require.NoError(t, err)
+
 	// Instantiate the detection repository implementation
 	repo, err = NewSQLiteRepository(db) // Use the constructor from this package
 	require.NoError(t, err)
@@ -61,14 +79,26 @@ func setupDetectionTestDB(t *testing.T) (db *sql.DB, repo Repository, cleanup fu
 }
 
 // Helper to insert test data directly for detection repo tests
-func insertTestData(t *testing.T, db *sql.DB, tx Transaction) {
+func insertTestData(t testing.TB, db *sql.DB, tx Transaction) {
 	t.Helper()
-	query := `INSERT INTO transactions (id, user_id, amount, type, timestamp, is_suspicious, flagged_rules) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	query := `INSERT INTO transactions (id, user_id, amount, type, timestamp, is_suspicious, flagged_rules, counterparty_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
 	flaggedRulesStr := strings.Join(tx.FlaggedRules, ",")
-	_, err := db.Exec(query, tx.ID, tx.UserID, tx.Amount, tx.Type, tx.Timestamp, tx.IsSuspicious, flaggedRulesStr)
+	counterpartyID := sql.NullString{String: tx.CounterpartyID, Valid: tx.CounterpartyID != ""}
+	_, err := db.Exec(query, tx.ID, tx.UserID, tx.Amount, tx.Type, tx.Timestamp, tx.IsSuspicious, flaggedRulesStr, counterpartyID)
 	require.NoError(t, err, "Failed to insert test data for tx ID %s", tx.ID)
 }
 
+// seedTransactions inserts txns and returns them by ID as the rules see them.
+func seedTransactions(t testing.TB, db *sql.DB, txns []Transaction) map[string]model.Transaction {
+	t.Helper()
+	byID := make(map[string]model.Transaction, len(txns))
+	for _, tx := range txns {
+		insertTestData(t, db, tx)
+		byID[tx.ID] = tx.toModel()
+	}
+	return byID
+}
+
 // TestDetectionRepository_Get tests the Get method with various filters.
 func TestDetectionRepository_Get(t *testing.T) {
 	db, repo, cleanup := setupDetectionTestDB(t)
@@ -124,6 +154,48 @@ func TestDetectionRepository_Get(t *testing.T) {
 	}
 }
 
+// TestDetectionRepository_Aggregates tests Count, Sum and AggregateByBucket against the same filters Get takes.
+func TestDetectionRepository_Aggregates(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, tx := range []Transaction{
+		{ID: "agg_1", UserID: "u1", Amount: 10, Type: model.DepositType, Timestamp: start.Add(5 * time.Minute)},
+		{ID: "agg_2", UserID: "u1", Amount: 20, Type: model.TransferType, Timestamp: start.Add(50 * time.Minute)},
+		{ID: "agg_3", UserID: "u1", Amount: 30, Type: model.TransferType, Timestamp: start.Add(2*time.Hour + 30*time.Second)},
+		{ID: "agg_other", UserID: "u2", Amount: 1000, Type: model.TransferType, Timestamp: start.Add(time.Hour)},
+	} {
+		insertTestData(t, db, tx)
+	}
+	until := start.Add(time.Hour)
+
+	count, err := repo.Count(ctx, Filter{UserID: "u1"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = repo.Count(ctx, Filter{UserID: "u1", Type: model.TransferType, Until: &until})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	sum, err := repo.Sum(ctx, Filter{UserID: "u1"})
+	require.NoError(t, err)
+	assert.Equal(t, 60.0, sum)
+	sum, err = repo.Sum(ctx, Filter{UserID: "u3"})
+	require.NoError(t, err)
+	assert.Zero(t, sum, "Nothing matches")
+
+	buckets, err := repo.AggregateByBucket(ctx, Filter{UserID: "u1"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []Bucket{
+		{Start: start, Count: 2, Sum: 30},
+		{Start: start.Add(2 * time.Hour), Count: 1, Sum: 30},
+	}, buckets, "Empty buckets are left out")
+
+	_, err = repo.AggregateByBucket(ctx, Filter{UserID: "u1"}, time.Millisecond)
+	assert.Error(t, err)
+}
+
 // TestDetectionRepository_UpdateSuspicionStatus_Success tests successful update.
 func TestDetectionRepository_UpdateSuspicionStatus_Success(t *testing.T) {
 	db, repo, cleanup := setupDetectionTestDB(t)
@@ -135,7 +207,17 @@ func TestDetectionRepository_UpdateSuspicionStatus_Success(t *testing.T) {
 	insertTestData(t, db, initialTx)
 
 	updatedRules := []string{"RuleX", "RuleY"}
-	err := repo.UpdateSuspicionStatus(ctx, txID, true, updatedRules)
+	assessment := Assessment{
+		RiskScore:    80,
+		RiskBand:     RiskHigh,
+		IsSuspicious: true,
+		FlaggedRules: updatedRules,
+		RiskFactors: []RiskFactor{
+			{Rule: "RuleX", Score: 50, Reason: "x", Evidence: &Evidence{Threshold: 10, Observed: 11, Window: "1h0m0s", RelatedTransactionIDs: []string{"a", "b"}}},
+			{Rule: "RuleY", Score: 30, Reason: "y"},
+		},
+	}
+	err := repo.UpdateSuspicionStatus(ctx, txID, assessment)
 	require.NoError(t, err, "UpdateSuspicionStatus failed")
 
 	// Verify Update using raw DB
@@ -148,6 +230,82 @@ func TestDetectionRepository_UpdateSuspicionStatus_Success(t *testing.T) {
 	require.NoError(t, err, "Failed to query updated row")
 	assert.True(t, retrievedIsSuspicious)
 	assert.Equal(t, strings.Join(updatedRules, ","), retrievedFlaggedRules)
+
+	analyzed, err := repo.Get(ctx, Filter{UserID: "u1", AnalysisStatus: StatusAnalyzed})
+	require.NoError(t, err)
+	require.Len(t, analyzed, 1, "Storing a verdict should mark the transaction ANALYZED")
+	assert.NotNil(t, analyzed[0].AnalyzedAt)
+	assert.Equal(t, 80.0, analyzed[0].RiskScore)
+	assert.Equal(t, RiskHigh, analyzed[0].RiskBand)
+	assert.Equal(t, assessment.RiskFactors, analyzed[0].RiskFactors)
+
+	minScore := 81.0
+	above, err := repo.Get(ctx, Filter{UserID: "u1", MinRiskScore: &minScore})
+	require.NoError(t, err)
+	assert.Empty(t, above)
+	high, err := repo.Get(ctx, Filter{UserID: "u1", RiskBand: RiskHigh})
+	require.NoError(t, err)
+	assert.Len(t, high, 1)
+}
+
+// TestDetectionRepository_Details tests that the counterparty, account, channel and metadata columns
+// reach both Get and the outbox, and that unset ones stay empty.
+func TestDetectionRepository_Details(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	insertTestData(t, db, Transaction{ID: "details_plain", UserID: "u1", Amount: 10, Type: model.DepositType, Timestamp: now.Add(-time.Minute)})
+	_, err := db.Exec(`INSERT INTO transactions (id, user_id, amount, type, timestamp, `+detailColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		"details_transfer", "u1", 250.0, model.TransferType, now, "acc_u1", "acc_u2", "u2", "Jane Doe", model.MobileChannel, `{"device":"ios","trusted":true}`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO transaction_outbox (transaction_id, created_at) VALUES (?, ?)`, "details_transfer", now)
+	require.NoError(t, err)
+
+	want := model.Transaction{
+		ID: "details_transfer", UserID: "u1", Amount: 250, Type: model.TransferType,
+		SourceAccount: "acc_u1", DestinationAccount: "acc_u2", CounterpartyID: "u2", CounterpartyName: "Jane Doe",
+		Channel: model.MobileChannel, Metadata: map[string]any{"device": "ios", "trusted": true},
+	}
+
+	txns, err := repo.Get(ctx, Filter{UserID: "u1"})
+	require.NoError(t, err)
+	require.Len(t, txns, 2)
+	assert.Equal(t, want, withoutTimestamp(txns[0].toModel()))
+	assert.Equal(t, model.Transaction{ID: "details_plain", UserID: "u1", Amount: 10, Type: model.DepositType}, withoutTimestamp(txns[1].toModel()))
+
+	claimed, err := NewSQLiteOutboxRepository(db).Claim(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, want, withoutTimestamp(claimed[0].Transaction))
+}
+
+func withoutTimestamp(txn model.Transaction) model.Transaction {
+	txn.Timestamp = time.Time{}
+	return txn
+}
+
+// TestDetectionRepository_UpdateAnalysisStatus tests status transitions and the not-found case.
+func TestDetectionRepository_UpdateAnalysisStatus(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	insertTestData(t, db, Transaction{ID: "status_1", UserID: "u1", Amount: 100, Type: "deposit", Timestamp: time.Now()})
+
+	pending, err := repo.Get(ctx, Filter{AnalysisStatus: StatusPending})
+	require.NoError(t, err)
+	require.Len(t, pending, 1, "New transactions should default to PENDING")
+
+	require.NoError(t, repo.UpdateAnalysisStatus(ctx, "status_1", StatusAnalyzing))
+	analyzing, err := repo.Get(ctx, Filter{AnalysisStatus: StatusAnalyzing})
+	require.NoError(t, err)
+	require.Len(t, analyzing, 1)
+	assert.Nil(t, analyzing[0].AnalyzedAt)
+
+	err = repo.UpdateAnalysisStatus(ctx, "non_existent_id", StatusFailed)
+	require.ErrorIs(t, err, ErrUpdateFailed)
 }
 
 // TestDetectionRepository_UpdateSuspicionStatus_NotFound tests update on non-existent ID.
@@ -156,9 +314,205 @@ func TestDetectionRepository_UpdateSuspicionStatus_NotFound(t *testing.T) {
 	defer cleanup()
 	ctx := context.Background()
 
-	err := repo.UpdateSuspicionStatus(ctx, "non_existent_id", true, []string{"RuleZ"})
+	err := repo.UpdateSuspicionStatus(ctx, "non_existent_id", Assessment{IsSuspicious: true, FlaggedRules: []string{"RuleZ"}})
 	require.Error(t, err, "Expected an error when updating non-existent ID")
 	// Ensure error is the one defined in the detection package (or imported)
 	require.ErrorIs(t, err, ErrUpdateFailed, "Expected specific ErrUpdateFailed")
 	assert.Contains(t, err.Error(), "no transaction found with id", "Error message mismatch")
 }
+
+// TestOutboxRepository_ClaimAndMarkDone tests that claimed entries are leased and done entries are not reclaimed.
+func TestOutboxRepository_ClaimAndMarkDone(t *testing.T) {
+	db, _, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	outbox := NewSQLiteOutboxRepository(db)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, id := range []string{"outbox_1", "outbox_2", "outbox_3"} {
+		insertTestData(t, db, Transaction{ID: id, UserID: "u1", Amount: 10, Type: model.DepositType, Timestamp: now})
+		_, err := db.Exec(`INSERT INTO transaction_outbox (transaction_id, created_at) VALUES (?, ?)`, id, now)
+		require.NoError(t, err)
+	}
+
+	claimed, err := outbox.Claim(ctx, 2, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	assert.Equal(t, "outbox_1", claimed[0].Transaction.ID)
+	assert.Equal(t, "outbox_2", claimed[1].Transaction.ID)
+	assert.Equal(t, 1, claimed[0].Attempts)
+
+	// Leased entries are hidden from the next poll.
+	next, err := outbox.Claim(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, next, 1)
+	assert.Equal(t, "outbox_3", next[0].Transaction.ID)
+
+	require.NoError(t, outbox.MarkDone(ctx, claimed[0].ID))
+
+	// An expired lease makes unfinished entries claimable again, but never finished ones.
+	_, err = db.Exec(`UPDATE transaction_outbox SET claimed_until = ?`, now.Add(-time.Minute))
+	require.NoError(t, err)
+	reclaimed, err := outbox.Claim(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, reclaimed, 2)
+	assert.Equal(t, "outbox_2", reclaimed[0].Transaction.ID)
+	assert.Equal(t, 2, reclaimed[0].Attempts)
+
+	err = outbox.MarkDone(ctx, 9999)
+	require.ErrorIs(t, err, ErrUpdateFailed)
+}
+
+// TestOutboxRepository_EnqueueStale tests that only stale, unqueued PENDING/ANALYZING transactions are re-enqueued.
+func TestOutboxRepository_EnqueueStale(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	outbox := NewSQLiteOutboxRepository(db)
+
+	old := time.Now().UTC().Add(-time.Hour)
+	for _, id := range []string{"stale_pending", "stale_analyzing", "stale_analyzed", "stale_queued", "fresh_pending"} {
+		ts := old
+		if id == "fresh_pending" {
+			ts = time.Now().UTC()
+		}
+		insertTestData(t, db, Transaction{ID: id, UserID: "u1", Amount: 10, Type: model.DepositType, Timestamp: ts})
+		_, err := db.Exec(`UPDATE transactions SET status_updated_at = ? WHERE id = ?`, ts, id)
+		require.NoError(t, err)
+	}
+	_, err := db.Exec(`UPDATE transactions SET analysis_status = ? WHERE id = ?`, StatusAnalyzing, "stale_analyzing")
+	require.NoError(t, err)
+	require.NoError(t, repo.UpdateSuspicionStatus(ctx, "stale_analyzed", Assessment{RiskBand: RiskLow}))
+	_, err = db.Exec(`INSERT INTO transaction_outbox (transaction_id, created_at) VALUES (?, ?)`, "stale_queued", old)
+	require.NoError(t, err)
+
+	count, err := outbox.EnqueueStale(ctx, time.Now().Add(-5*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	claimed, err := outbox.Claim(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	claimedIDs := make([]string, len(claimed))
+	for i, e := range claimed {
+		claimedIDs[i] = e.Transaction.ID
+	}
+	assert.ElementsMatch(t, []string{"stale_queued", "stale_pending", "stale_analyzing"}, claimedIDs)
+}
+
+// TestDeadLetterRepository_Lifecycle tests dead lettering an outbox entry, then listing, replaying and discarding it.
+func TestDeadLetterRepository_Lifecycle(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	outbox := NewSQLiteOutboxRepository(db)
+	deadLetters := NewSQLiteDeadLetterRepository(db)
+
+	now := time.Now().UTC()
+	for _, id := range []string{"dl_1", "dl_2"} {
+		insertTestData(t, db, Transaction{ID: id, UserID: "u1", Amount: 10, Type: model.DepositType, Timestamp: now})
+		_, err := db.Exec(`INSERT INTO transaction_outbox (transaction_id, created_at) VALUES (?, ?)`, id, now)
+		require.NoError(t, err)
+	}
+	claimed, err := outbox.Claim(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+
+	for _, entry := range claimed {
+		err = outbox.DeadLetter(ctx, entry.ID, DeadLetter{TransactionID: entry.Transaction.ID, Rule: "RuleX", Error: "boom", Attempts: 5})
+		require.NoError(t, err)
+	}
+
+	// Dead lettered entries are finished and never claimed again.
+	_, err = db.Exec(`UPDATE transaction_outbox SET claimed_until = NULL`)
+	require.NoError(t, err)
+	remaining, err := outbox.Claim(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, remaining)
+
+	listed, err := deadLetters.List(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	assert.Equal(t, "dl_2", listed[0].TransactionID, "Newest dead letter first")
+	assert.Equal(t, "RuleX", listed[0].Rule)
+	assert.Equal(t, 5, listed[0].Attempts)
+
+	require.NoError(t, deadLetters.Replay(ctx, listed[0].ID))
+	replayed, err := outbox.Claim(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, replayed, 1)
+	assert.Equal(t, "dl_2", replayed[0].Transaction.ID)
+	assert.Equal(t, 1, replayed[0].Attempts, "Replay should start with a fresh attempt count")
+	pending, err := repo.Get(ctx, Filter{AnalysisStatus: StatusPending})
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+
+	require.NoError(t, deadLetters.Discard(ctx, listed[1].ID))
+	listed, err = deadLetters.List(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, listed)
+
+	require.ErrorIs(t, deadLetters.Replay(ctx, 9999), ErrDeadLetterNotFound)
+	require.ErrorIs(t, deadLetters.Discard(ctx, 9999), ErrDeadLetterNotFound)
+}
+
+// seedBenchmarkData inserts users * perUser transactions, one a minute per user, ending at end.
+func seedBenchmarkData(b *testing.B, db *sql.DB, users, perUser int, end time.Time) {
+	b.Helper()
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_transactions_user_type_timestamp ON transactions(user_id, type, timestamp)`)
+	require.NoError(b, err)
+
+	sqlTx, err := db.Begin()
+	require.NoError(b, err)
+	stmt, err := sqlTx.Prepare(`INSERT INTO transactions (id, user_id, amount, type, timestamp, flagged_rules, risk_factors) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	require.NoError(b, err)
+	types := []string{model.DepositType, model.WithdrawalType, model.TransferType}
+	for u := 0; u < users; u++ {
+		for i := 0; i < perUser; i++ {
+			_, err := stmt.Exec(fmt.Sprintf("bench_%d_%d", u, i), fmt.Sprintf("user_%d", u), float64(i%200), types[i%len(types)],
+				end.Add(-time.Duration(i)*time.Minute), "FrequentSmallTransactions", `[{"rule":"FrequentSmallTransactions","score":50}]`)
+			require.NoError(b, err)
+		}
+	}
+	require.NoError(b, stmt.Close())
+	require.NoError(b, sqlTx.Commit())
+}
+
+// BenchmarkDetectionRepository_Window compares loading a user's 24h window, as the rules used to, with
+// counting and summing it. Run with: go test ./internal/detection -run '^$' -bench Window -benchmem
+func BenchmarkDetectionRepository_Window(b *testing.B) {
+	db, repo, cleanup := setupDetectionTestDB(b)
+	defer cleanup()
+	ctx := context.Background()
+
+	end := time.Date(2025, 5, 8, 0, 0, 0, 0, time.UTC)
+	seedBenchmarkData(b, db, 20, 7*24*60/2, end) // 20 users, 3.5 days each, 100,800 transactions
+	since := end.Add(-24 * time.Hour)
+	threshold := 100.0
+	filters := Filter{UserID: "user_7", AmountLessThan: &threshold, Since: &since, Until: &end}
+
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			txns, err := repo.Get(ctx, filters)
+			require.NoError(b, err)
+			_ = len(txns)
+		}
+	})
+	b.Run("Count", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := repo.Count(ctx, filters)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("Sum", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := repo.Sum(ctx, filters)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("AggregateByBucket", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := repo.AggregateByBucket(ctx, filters, time.Hour)
+			require.NoError(b, err)
+		}
+	})
+}
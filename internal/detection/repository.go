@@ -3,25 +3,61 @@ package detection
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
 )
 
 type Filter struct {
 	UserID         string
 	IsSuspicious   *bool
 	Type           string
+	Types          []string // Any of these
+	CounterpartyID string
 	AmountLessThan *float64
+	AmountAtLeast  *float64
 	Since          *time.Time
+	Until          *time.Time // Inclusive, so a rule can evaluate a transaction as of its own timestamp
+	Before         *time.Time // Exclusive
+	AnalysisStatus AnalysisStatus
+	MinRiskScore   *float64
+	RiskBand       RiskBand
+}
+
+// Bucket is the count and total amount of the transactions in [Start, Start+size).
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+	Sum   float64   `json:"sum"`
 }
 
+// Repository reads and updates transactions for detection. Rules that only need a number or the latest
+// transaction should use Count, Sum, AggregateByBucket or Last rather than Get, which loads every
+// matching row.
 type Repository interface {
 	Get(ctx context.Context, filters Filter) ([]Transaction, error)
-	UpdateSuspicionStatus(ctx context.Context, transactionID string, isSuspicious bool, flaggedRules []string) error
+	Last(ctx context.Context, filters Filter) (Transaction, bool, error)
+	Count(ctx context.Context, filters Filter) (int, error)
+	Sum(ctx context.Context, filters Filter) (float64, error)
+	AggregateByBucket(ctx context.Context, filters Filter, size time.Duration) ([]Bucket, error)
+	Distinct(ctx context.Context, filters Filter, field Field) ([]string, error)
+	Profile(ctx context.Context, userID string, since, before time.Time) (UserProfile, error)
+	UpdateSuspicionStatus(ctx context.Context, transactionID string, assessment Assessment) error
+	UpdateAnalysisStatus(ctx context.Context, transactionID string, status AnalysisStatus) error
 }
 
+// Field is a column Distinct can list the values of.
+type Field string
+
+const (
+	FieldUserID         Field = "user_id"
+	FieldCounterpartyID Field = "counterparty_id"
+)
+
 var (
 	ErrUpdateFailed = errors.New("failed to update transaction")
 )
@@ -36,7 +72,193 @@ func NewSQLiteRepository(db *sql.DB) (Repository, error) {
 
 // Reusing transactions table, this could be split off into a separate table/DB for scaling
 func (r *sqliteRepository) Get(ctx context.Context, filters Filter) ([]Transaction, error) {
-	baseQuery := `SELECT id, user_id, amount, type, timestamp, is_suspicious, flagged_rules FROM transactions`
+	return r.get(ctx, filters, 0)
+}
+
+// Last returns the newest transaction matching filters, and false when there is none.
+func (r *sqliteRepository) Last(ctx context.Context, filters Filter) (Transaction, bool, error) {
+	txns, err := r.get(ctx, filters, 1)
+	if err != nil || len(txns) == 0 {
+		return Transaction{}, false, err
+	}
+	return txns[0], true, nil
+}
+
+// get returns the transactions matching filters, newest first, at most limit of them unless it is 0.
+func (r *sqliteRepository) get(ctx context.Context, filters Filter, limit int) ([]Transaction, error) {
+	baseQuery := `SELECT id, user_id, amount, type, timestamp, is_suspicious, flagged_rules, analysis_status, analyzed_at, risk_score, risk_band, risk_factors, rules_version, ` +
+		detailColumns + ` FROM transactions`
+	where, args := whereClause(filters)
+	query := baseQuery + where + " ORDER BY timestamp DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query transactions with filters (%+v): %w", filters, err)
+	}
+	defer rows.Close()
+
+	transactions := make([]Transaction, 0)
+	for rows.Next() {
+		var base model.Transaction
+		var verdict Transaction
+		var flaggedRulesDB sql.NullString
+		var analyzedAt sql.NullTime
+		var riskBand, riskFactors, rulesVersion sql.NullString
+		var details transactionDetails
+		err := rows.Scan(append([]any{&base.ID, &base.UserID, &base.Amount, &base.Type, &base.Timestamp, &verdict.IsSuspicious, &flaggedRulesDB,
+			&verdict.AnalysisStatus, &analyzedAt, &verdict.RiskScore, &riskBand, &riskFactors, &rulesVersion}, details.targets()...)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan transaction row: %w", err)
+		}
+		if err := details.apply(&base); err != nil {
+			return nil, err
+		}
+		tx := fromModel(base)
+		tx.IsSuspicious, tx.AnalysisStatus, tx.RiskScore = verdict.IsSuspicious, verdict.AnalysisStatus, verdict.RiskScore
+		if flaggedRulesDB.Valid && flaggedRulesDB.String != "" {
+			tx.FlaggedRules = strings.Split(flaggedRulesDB.String, ",")
+		} else {
+			tx.FlaggedRules = []string{}
+		}
+		if analyzedAt.Valid {
+			tx.AnalyzedAt = &analyzedAt.Time
+		}
+		tx.RiskBand = RiskBand(riskBand.String)
+		tx.RulesVersion = rulesVersion.String
+		tx.RiskFactors = []RiskFactor{}
+		if riskFactors.Valid && riskFactors.String != "" {
+			if err := json.Unmarshal([]byte(riskFactors.String), &tx.RiskFactors); err != nil {
+				return nil, fmt.Errorf("failed to decode risk factors of transaction %s: %w", tx.ID, err)
+			}
+		}
+		transactions = append(transactions, tx)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating transaction rows: %w", err)
+	}
+
+	return transactions, nil
+}
+
+// Count returns the number of transactions matching filters, without loading them.
+func (r *sqliteRepository) Count(ctx context.Context, filters Filter) (int, error) {
+	where, args := whereClause(filters)
+	var count int
+	if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM transactions`+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count transactions with filters (%+v): %w", filters, err)
+	}
+	return count, nil
+}
+
+// Sum returns the total amount of the transactions matching filters, 0 when nothing matches.
+func (r *sqliteRepository) Sum(ctx context.Context, filters Filter) (float64, error) {
+	where, args := whereClause(filters)
+	var sum float64
+	if err := r.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM transactions`+where, args...).Scan(&sum); err != nil {
+		return 0, fmt.Errorf("failed to sum transactions with filters (%+v): %w", filters, err)
+	}
+	return sum, nil
+}
+
+// Distinct returns the values of field in the transactions matching filters without duplicates, the
+// most recently seen first. Transactions without a value are left out.
+func (r *sqliteRepository) Distinct(ctx context.Context, filters Filter, field Field) ([]string, error) {
+	if field != FieldUserID && field != FieldCounterpartyID {
+		return nil, fmt.Errorf("cannot list distinct values of %q", field)
+	}
+	where, args := whereClause(filters)
+	if where == "" {
+		where = " WHERE "
+	} else {
+		where += " AND "
+	}
+	query := fmt.Sprintf(`SELECT %[1]s FROM transactions%[2]s%[1]s IS NOT NULL AND %[1]s != '' GROUP BY %[1]s ORDER BY MAX(timestamp) DESC`, field, where)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list distinct %s with filters (%+v): %w", field, filters, err)
+	}
+	defer rows.Close()
+
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("failed to scan distinct %s row: %w", field, err)
+		}
+		values = append(values, value)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating distinct %s rows: %w", field, err)
+	}
+	return values, nil
+}
+
+// AggregateByBucket groups the transactions matching filters into buckets of the given size, aligned
+// to the Unix epoch, and returns the non-empty ones oldest first.
+func (r *sqliteRepository) AggregateByBucket(ctx context.Context, filters Filter, size time.Duration) ([]Bucket, error) {
+	seconds := int64(size / time.Second)
+	if seconds <= 0 {
+		return nil, fmt.Errorf("bucket size must be at least a second, got %v", size)
+	}
+	where, args := whereClause(filters)
+	query := `SELECT CAST(strftime('%s', timestamp) AS INTEGER) / ? AS bucket, COUNT(*), SUM(amount) FROM transactions` + where +
+		` GROUP BY bucket ORDER BY bucket`
+
+	rows, err := r.db.QueryContext(ctx, query, append([]any{seconds}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate transactions with filters (%+v): %w", filters, err)
+	}
+	defer rows.Close()
+
+	buckets := make([]Bucket, 0)
+	for rows.Next() {
+		var index int64
+		var bucket Bucket
+		if err := rows.Scan(&index, &bucket.Count, &bucket.Sum); err != nil {
+			return nil, fmt.Errorf("failed to scan bucket row: %w", err)
+		}
+		bucket.Start = time.Unix(index*seconds, 0).UTC()
+		buckets = append(buckets, bucket)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating bucket rows: %w", err)
+	}
+	return buckets, nil
+}
+
+// detailColumns are the optional columns saying where a transaction's money moves, see model.Transaction.
+const detailColumns = `source_account, destination_account, counterparty_id, counterparty_name, channel, metadata`
+
+// transactionDetails scans detailColumns, which are NULL when not set.
+type transactionDetails struct {
+	sourceAccount, destinationAccount, counterpartyID, counterpartyName, channel, metadata sql.NullString
+}
+
+func (d *transactionDetails) targets() []any {
+	return []any{&d.sourceAccount, &d.destinationAccount, &d.counterpartyID, &d.counterpartyName, &d.channel, &d.metadata}
+}
+
+// apply sets the scanned details on txn.
+func (d *transactionDetails) apply(txn *model.Transaction) error {
+	txn.SourceAccount = d.sourceAccount.String
+	txn.DestinationAccount = d.destinationAccount.String
+	txn.CounterpartyID = d.counterpartyID.String
+	txn.CounterpartyName = d.counterpartyName.String
+	txn.Channel = d.channel.String
+	if d.metadata.Valid && d.metadata.String != "" {
+		if err := json.Unmarshal([]byte(d.metadata.String), &txn.Metadata); err != nil {
+			return fmt.Errorf("failed to decode metadata of transaction %s: %w", txn.ID, err)
+		}
+	}
+	return nil
+}
+
+// whereClause translates filters into a WHERE clause, empty when nothing is filtered, and its arguments.
+func whereClause(filters Filter) (string, []any) {
 	whereClauses := []string{}
 	args := []any{}
 
@@ -52,61 +274,111 @@ func (r *sqliteRepository) Get(ctx context.Context, filters Filter) ([]Transacti
 		whereClauses = append(whereClauses, "type = ?")
 		args = append(args, filters.Type)
 	}
+	if len(filters.Types) > 0 {
+		whereClauses = append(whereClauses, "type IN (?"+strings.Repeat(", ?", len(filters.Types)-1)+")")
+		for _, t := range filters.Types {
+			args = append(args, t)
+		}
+	}
+	if filters.CounterpartyID != "" {
+		whereClauses = append(whereClauses, "counterparty_id = ?")
+		args = append(args, filters.CounterpartyID)
+	}
 	if filters.AmountLessThan != nil {
 		whereClauses = append(whereClauses, "amount < ?")
 		args = append(args, *filters.AmountLessThan)
 	}
+	if filters.AmountAtLeast != nil {
+		whereClauses = append(whereClauses, "amount >= ?")
+		args = append(args, *filters.AmountAtLeast)
+	}
 	if filters.Since != nil {
 		whereClauses = append(whereClauses, "timestamp >= ?")
 		args = append(args, *filters.Since)
 	}
+	if filters.Until != nil {
+		whereClauses = append(whereClauses, "timestamp <= ?")
+		args = append(args, *filters.Until)
+	}
+	if filters.Before != nil {
+		whereClauses = append(whereClauses, "timestamp < ?")
+		args = append(args, *filters.Before)
+	}
+	if filters.AnalysisStatus != "" {
+		whereClauses = append(whereClauses, "analysis_status = ?")
+		args = append(args, filters.AnalysisStatus)
+	}
+	if filters.MinRiskScore != nil {
+		whereClauses = append(whereClauses, "risk_score >= ?")
+		args = append(args, *filters.MinRiskScore)
+	}
+	if filters.RiskBand != "" {
+		whereClauses = append(whereClauses, "risk_band = ?")
+		args = append(args, filters.RiskBand)
+	}
 
-	query := baseQuery
-	if len(whereClauses) > 0 {
-		query += " WHERE " + strings.Join(whereClauses, " AND ")
+	if len(whereClauses) == 0 {
+		return "", nil
 	}
-	query += " ORDER BY timestamp DESC"
+	return " WHERE " + strings.Join(whereClauses, " AND "), args
+}
 
-	rows, err := r.db.QueryContext(ctx, query, args...)
+// UpdateSuspicionStatus stores the assessment, including its shadow hits, and marks the transaction as
+// ANALYZED, in one SQL transaction.
+func (r *sqliteRepository) UpdateSuspicionStatus(ctx context.Context, transactionID string, assessment Assessment) (err error) {
+	query := `UPDATE transactions SET is_suspicious = ?, flagged_rules = ?, risk_score = ?, risk_band = ?, risk_factors = ?,
+		rules_version = ?, analysis_status = ?, status_updated_at = ?, analyzed_at = ? WHERE id = ?`
+	flaggedRulesStr := strings.Join(assessment.FlaggedRules, ",")
+	riskFactors, err := json.Marshal(assessment.RiskFactors)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query transactions with filters (%+v): %w", filters, err)
+		return fmt.Errorf("failed to encode risk factors for transaction id %s: %w", transactionID, err)
 	}
-	defer rows.Close()
+	now := time.Now().UTC()
 
-	transactions := make([]Transaction, 0)
-	for rows.Next() {
-		var tx Transaction
-		var flaggedRulesDB sql.NullString
-		err := rows.Scan(&tx.ID, &tx.UserID, &tx.Amount, &tx.Type, &tx.Timestamp, &tx.IsSuspicious, &flaggedRulesDB)
+	sqlTx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin update for transaction id %s: %w", transactionID, err)
+	}
+	defer func() {
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan transaction row: %w", err)
+			_ = sqlTx.Rollback()
 		}
-		if flaggedRulesDB.Valid && flaggedRulesDB.String != "" {
-			tx.FlaggedRules = strings.Split(flaggedRulesDB.String, ",")
-		} else {
-			tx.FlaggedRules = []string{}
-		}
-		transactions = append(transactions, tx)
+	}()
+
+	result, err := sqlTx.ExecContext(ctx, query, assessment.IsSuspicious, flaggedRulesStr, assessment.RiskScore, assessment.RiskBand, string(riskFactors),
+		assessment.RulesVersion, StatusAnalyzed, now, now, transactionID)
+	if err != nil {
+		return fmt.Errorf("failed to execute update for transaction id %s: %w", transactionID, err)
 	}
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating transaction rows: %w", err)
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		fmt.Printf("Warning: Could not get rows affected for update on tx id %s: %v\n", transactionID, err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: no transaction found with id %s to update", ErrUpdateFailed, transactionID)
 	}
 
-	return transactions, nil
+	if err = insertShadowHits(ctx, sqlTx, transactionID, assessment.ShadowHits, now); err != nil {
+		return err
+	}
+	if err = sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit update for transaction id %s: %w", transactionID, err)
+	}
+	return nil
 }
 
-func (r *sqliteRepository) UpdateSuspicionStatus(ctx context.Context, transactionID string, isSuspicious bool, flaggedRules []string) error {
-	query := `UPDATE transactions SET is_suspicious = ?, flagged_rules = ? WHERE id = ?`
-	flaggedRulesStr := strings.Join(flaggedRules, ",")
+func (r *sqliteRepository) UpdateAnalysisStatus(ctx context.Context, transactionID string, status AnalysisStatus) error {
+	query := `UPDATE transactions SET analysis_status = ?, status_updated_at = ? WHERE id = ?`
 
-	result, err := r.db.ExecContext(ctx, query, isSuspicious, flaggedRulesStr, transactionID)
+	result, err := r.db.ExecContext(ctx, query, status, time.Now().UTC(), transactionID)
 	if err != nil {
-		return fmt.Errorf("failed to execute update for transaction id %s: %w", transactionID, err)
+		return fmt.Errorf("failed to update analysis status for transaction id %s: %w", transactionID, err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		fmt.Printf("Warning: Could not get rows affected for update on tx id %s: %v\n", transactionID, err)
+		fmt.Printf("Warning: Could not get rows affected for status update on tx id %s: %v\n", transactionID, err)
 	}
 	if rowsAffected == 0 {
 		return fmt.Errorf("%w: no transaction found with id %s to update", ErrUpdateFailed, transactionID)
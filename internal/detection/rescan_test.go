@@ -0,0 +1,86 @@
+package detection
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/config"
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestManager_Rescan tests that a rescan updates flags both ways, only for the selected transactions,
+// and records the rules version.
+func TestManager_Rescan(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, tx := range []Transaction{
+		{ID: "rs_mid", UserID: "u1", Amount: 15000, Type: model.DepositType, Timestamp: now.Add(-3 * time.Hour), IsSuspicious: true, FlaggedRules: []string{highVolumeRuleName}},
+		{ID: "rs_big", UserID: "u1", Amount: 60000, Type: model.DepositType, Timestamp: now.Add(-2 * time.Hour)},
+		{ID: "rs_other_user", UserID: "u2", Amount: 60000, Type: model.DepositType, Timestamp: now.Add(-time.Hour)},
+		{ID: "rs_old", UserID: "u1", Amount: 60000, Type: model.DepositType, Timestamp: now.Add(-48 * time.Hour)},
+	} {
+		insertTestData(t, db, tx)
+	}
+	_, err := db.Exec(`UPDATE transactions SET analysis_status = ?`, StatusAnalyzed)
+	require.NoError(t, err)
+
+	manager := NewManager(repo)
+	manager.SetRules("v2", []Rule{NewHighVolumeRule(50000, 70)}, DefaultRiskBands)
+
+	from := now.Add(-24 * time.Hour)
+	report, err := manager.Rescan(ctx, RescanFilter{UserID: "u1", From: &from})
+	require.NoError(t, err)
+	assert.Equal(t, "v2", report.RulesVersion)
+	assert.Equal(t, 2, report.Scanned)
+	assert.Equal(t, []string{"rs_big"}, report.NewlyFlagged)
+	assert.Equal(t, []string{"rs_mid"}, report.NoLongerFlagged)
+	assert.Empty(t, report.Failed)
+
+	analyzed, err := repo.Get(ctx, Filter{UserID: "u1", Since: &from})
+	require.NoError(t, err)
+	for _, tx := range analyzed {
+		assert.Equal(t, "v2", tx.RulesVersion)
+		assert.Equal(t, tx.ID == "rs_big", tx.IsSuspicious)
+	}
+
+	t.Run("by rule", func(t *testing.T) {
+		report, err := manager.Rescan(ctx, RescanFilter{From: &from, Rule: highVolumeRuleName})
+		require.NoError(t, err)
+		assert.Equal(t, 3, report.Scanned, "Transactions the rule does not flag yet are rescanned too")
+		assert.Equal(t, []string{"rs_other_user"}, report.NewlyFlagged)
+		assert.Empty(t, report.NoLongerFlagged)
+	})
+
+	t.Run("unknown rule", func(t *testing.T) {
+		_, err := manager.Rescan(ctx, RescanFilter{From: &from, Rule: "NoSuchRule"})
+		require.ErrorIs(t, err, ErrUnknownRule)
+	})
+}
+
+// TestRuleVersionRepository tests that rule versions round trip and unknown ones are reported.
+func TestRuleVersionRepository(t *testing.T) {
+	db, _, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	versions := NewSQLiteRuleVersionRepository(db)
+
+	rules := config.Rules{
+		Bands:          config.RiskBands{Medium: 40, High: 70, Flag: "MEDIUM"},
+		RapidTransfers: config.RapidTransfers{Mode: config.ModeShadow, Weight: 60, MinConsecutive: 3, Window: 5 * time.Minute},
+	}
+	require.NoError(t, versions.Save(ctx, rules.Version(), rules))
+	require.NoError(t, versions.Save(ctx, rules.Version(), rules), "Saving a version again is a no-op")
+
+	loaded, err := versions.Get(ctx, rules.Version())
+	require.NoError(t, err)
+	assert.Equal(t, rules, loaded)
+
+	_, err = versions.Get(ctx, "unknown")
+	require.ErrorIs(t, err, ErrRuleVersionNotFound)
+}
@@ -0,0 +1,45 @@
+package detection
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetryPolicy decides when a failed detection is attempted again and when it is given up on.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// Exhausted reports whether no more attempts should be made after the given number of attempts.
+func (p RetryPolicy) Exhausted(attempts int) bool {
+	return attempts >= p.MaxAttempts
+}
+
+// Backoff returns the delay before the next attempt, given the number of attempts made so far.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < attempts; i++ {
+		backoff *= p.Multiplier
+		if p.MaxBackoff > 0 && backoff >= float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+	return time.Duration(backoff)
+}
+
+// RuleError identifies the rule that failed while evaluating a transaction.
+type RuleError struct {
+	Rule string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("rule %s: %v", e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,33 @@
+package detection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRetryPolicy tests that the backoff grows by the multiplier up to the max backoff, and that
+// attempts are exhausted once the max attempts have been made.
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2}
+	tests := []struct {
+		attempts    int
+		wantBackoff time.Duration
+		exhausted   bool
+	}{
+		{attempts: 1, wantBackoff: time.Second},
+		{attempts: 2, wantBackoff: 2 * time.Second},
+		{attempts: 3, wantBackoff: 4 * time.Second},
+		{attempts: 4, wantBackoff: 8 * time.Second},
+		{attempts: 5, wantBackoff: 10 * time.Second, exhausted: true}, // Capped
+		{attempts: 50, wantBackoff: 10 * time.Second, exhausted: true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.wantBackoff, policy.Backoff(tt.attempts), "Backoff after %d attempts", tt.attempts)
+		assert.Equal(t, tt.exhausted, policy.Exhausted(tt.attempts), "Exhausted after %d attempts", tt.attempts)
+	}
+
+	uncapped := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, Multiplier: 3}
+	assert.Equal(t, 81*time.Second, uncapped.Backoff(5), "No max backoff")
+}
@@ -0,0 +1,163 @@
+package detection
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jasimvs/sample-go-svc/config"
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+const maxRiskScore = 100
+
+// RiskBand buckets the 0-100 risk score.
+type RiskBand string
+
+const (
+	RiskLow    RiskBand = "LOW"
+	RiskMedium RiskBand = "MEDIUM"
+	RiskHigh   RiskBand = "HIGH"
+)
+
+var riskBandRank = map[RiskBand]int{RiskLow: 0, RiskMedium: 1, RiskHigh: 2}
+
+// RiskBands maps a risk score to a band, and decides from which band on a transaction is flagged.
+type RiskBands struct {
+	Medium   float64  // Lowest score in the medium band
+	High     float64  // Lowest score in the high band
+	FlagFrom RiskBand // Transactions in this band or above are flagged as suspicious
+}
+
+// DefaultRiskBands is used until SetRules is called.
+var DefaultRiskBands = RiskBands{Medium: 40, High: 70, FlagFrom: RiskMedium}
+
+// NewRiskBands converts the validated bands config.
+func NewRiskBands(cfg config.RiskBands) RiskBands {
+	return RiskBands{Medium: cfg.Medium, High: cfg.High, FlagFrom: RiskBand(cfg.Flag)}
+}
+
+func (b RiskBands) Band(score float64) RiskBand {
+	switch {
+	case score >= b.High:
+		return RiskHigh
+	case score >= b.Medium:
+		return RiskMedium
+	default:
+		return RiskLow
+	}
+}
+
+// Flags reports whether a transaction with score is suspicious. A transaction no rule scored is never
+// flagged, whatever the bands.
+func (b RiskBands) Flags(score float64) bool {
+	return score > 0 && riskBandRank[b.Band(score)] >= riskBandRank[b.FlagFrom]
+}
+
+// Result is a rule's verdict on one transaction. A zero Score means the rule did not match.
+type Result struct {
+	Score    float64 // Points towards the risk score, normally the rule's configured weight
+	Reason   string
+	Evidence *Evidence
+}
+
+// Evidence is what a rule observed when it matched, so a reviewer can see why it fired.
+type Evidence struct {
+	Threshold             float64  `json:"threshold,omitempty"`
+	Observed              float64  `json:"observed,omitempty"`
+	Window                string   `json:"window,omitempty"`
+	RelatedTransactionIDs []string `json:"related_transaction_ids,omitempty"` // Transactions that counted towards Observed, newest first
+	Counterparties        []string `json:"counterparties,omitempty"`          // Users on the other side that counted towards Observed, newest first
+}
+
+// RiskFactor is one matched rule's contribution to a transaction's risk score.
+type RiskFactor struct {
+	Rule     string    `json:"rule"`
+	Score    float64   `json:"score"`
+	Reason   string    `json:"reason"`
+	Evidence *Evidence `json:"evidence,omitempty"`
+}
+
+// Assessment is the outcome of running a rule set against a transaction.
+type Assessment struct {
+	RiskScore    float64
+	RiskBand     RiskBand
+	IsSuspicious bool
+	FlaggedRules []string
+	RiskFactors  []RiskFactor
+	ShadowHits   []RiskFactor // Matched shadow rules, which do not count towards RiskScore
+	RulesVersion string
+}
+
+// Assess runs every rule against txn and adds the enforced rules' scores up, capped at 100. Shadow
+// rules only end up in ShadowHits, and their errors are logged rather than failing the assessment.
+func (m *Manager) Assess(txn model.Transaction) (Assessment, error) {
+	assessment, err := m.rules.Load().assess(txn)
+	if err != nil {
+		return Assessment{}, err
+	}
+	if assessment.RiskScore > 0 {
+		log.Printf("Detection Manager: Tx ID %s scored %.1f (%s): %v", txn.ID, assessment.RiskScore, assessment.RiskBand, assessment.RiskFactors)
+	}
+	if len(assessment.ShadowHits) > 0 {
+		log.Printf("Detection Manager: Tx ID %s matched shadow rules: %v", txn.ID, assessment.ShadowHits)
+	}
+	return assessment, nil
+}
+
+func (s *ruleSet) assess(txn model.Transaction) (Assessment, error) {
+	assessment := Assessment{RulesVersion: s.version}
+	for _, rule := range s.rules {
+		if shadow, ok := rule.(*ShadowRule); ok {
+			result, err := shadow.DetectSuspiciousActivity(txn)
+			if err != nil {
+				log.Printf("Detection Manager: Shadow rule %s failed on Tx ID %s: %v", shadow.Name(), txn.ID, err)
+			} else if result.Score > 0 {
+				assessment.ShadowHits = append(assessment.ShadowHits, newRiskFactor(shadow.Name(), result))
+			}
+			continue
+		}
+
+		result, err := rule.DetectSuspiciousActivity(txn)
+		if err != nil {
+			return Assessment{}, &RuleError{Rule: rule.Name(), Err: err}
+		}
+		if result.Score <= 0 {
+			continue
+		}
+		assessment.RiskScore += result.Score
+		assessment.FlaggedRules = append(assessment.FlaggedRules, rule.Name())
+		assessment.RiskFactors = append(assessment.RiskFactors, newRiskFactor(rule.Name(), result))
+	}
+
+	assessment.RiskScore = min(assessment.RiskScore, maxRiskScore)
+	assessment.RiskBand = s.bands.Band(assessment.RiskScore)
+	assessment.IsSuspicious = s.bands.Flags(assessment.RiskScore)
+	return assessment, nil
+}
+
+func newRiskFactor(rule string, result Result) RiskFactor {
+	return RiskFactor{Rule: rule, Score: result.Score, Reason: result.Reason, Evidence: result.Evidence}
+}
+
+func (f RiskFactor) String() string {
+	return fmt.Sprintf("%s +%.1f (%s)", f.Rule, f.Score, f.Reason)
+}
+
+// transactionIDs lists the IDs of txns, in order.
+func transactionIDs(txns []Transaction) []string {
+	ids := make([]string, len(txns))
+	for i, txn := range txns {
+		ids[i] = txn.ID
+	}
+	return ids
+}
+
+// summarizeIDs lists the first few ids for a human readable reason. The evidence has all of them.
+func summarizeIDs(ids []string) string {
+	const shown = 5
+	if len(ids) > shown {
+		return strings.Join(ids[:shown], ", ") + ", ..."
+	}
+	return strings.Join(ids, ", ")
+}
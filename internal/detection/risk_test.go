@@ -0,0 +1,45 @@
+package detection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestManager_Assess tests that rule scores add up, are capped at 100 and that the bands decide what is flagged.
+func TestManager_Assess(t *testing.T) {
+	_, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	txn := model.Transaction{ID: "tx_1", UserID: "user_1", Amount: 20000, Type: model.WithdrawalType, Timestamp: time.Now().UTC()}
+	bands := RiskBands{Medium: 40, High: 70, FlagFrom: RiskHigh}
+
+	tests := []struct {
+		name           string
+		rules          []Rule
+		wantScore      float64
+		wantBand       RiskBand
+		wantSuspicious bool
+	}{
+		{"no match", []Rule{NewHighVolumeRule(50000, 30)}, 0, RiskLow, false},
+		{"below flag band", []Rule{NewHighVolumeRule(10000, 50)}, 50, RiskMedium, false},
+		{"scores add up", []Rule{NewHighVolumeRule(10000, 50), NewHighVolumeRule(15000, 30)}, 80, RiskHigh, true},
+		{"capped at 100", []Rule{NewHighVolumeRule(10000, 80), NewHighVolumeRule(15000, 80)}, 100, RiskHigh, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := NewManager(repo)
+			manager.SetRules("test", tt.rules, bands)
+
+			assessment, err := manager.Assess(txn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantScore, assessment.RiskScore)
+			assert.Equal(t, tt.wantBand, assessment.RiskBand)
+			assert.Equal(t, tt.wantSuspicious, assessment.IsSuspicious)
+			assert.Len(t, assessment.RiskFactors, len(assessment.FlaggedRules))
+		})
+	}
+}
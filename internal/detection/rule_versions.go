@@ -0,0 +1,76 @@
+package detection
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/config"
+)
+
+var ErrRuleVersionNotFound = errors.New("rule version not found")
+
+// RuleVersionRepository keeps the configuration of every rule set that has been in use, so the
+// rules_version stored with a verdict can be looked up and the verdict reproduced, e.g. by a backtest.
+type RuleVersionRepository interface {
+	Migrate(ctx context.Context) error
+	Save(ctx context.Context, version string, rules config.Rules) error
+	Get(ctx context.Context, version string) (config.Rules, error)
+}
+
+type sqliteRuleVersionRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteRuleVersionRepository(db *sql.DB) RuleVersionRepository {
+	if db == nil {
+		panic("database connection (*sql.DB) is required for NewSQLiteRuleVersionRepository")
+	}
+	return &sqliteRuleVersionRepository{db: db}
+}
+
+func (r *sqliteRuleVersionRepository) Migrate(ctx context.Context) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS rule_versions (
+        version TEXT PRIMARY KEY,
+        rules TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL
+    );`
+	if _, err := r.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create rule_versions table: %w", err)
+	}
+	return nil
+}
+
+// Save stores rules under version. Versions are content hashes, so saving one again is a no-op.
+func (r *sqliteRuleVersionRepository) Save(ctx context.Context, version string, rules config.Rules) error {
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("failed to encode rule version %s: %w", version, err)
+	}
+	query := `INSERT INTO rule_versions (version, rules, created_at) VALUES (?, ?, ?) ON CONFLICT (version) DO NOTHING`
+	if _, err := r.db.ExecContext(ctx, query, version, string(encoded), time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to save rule version %s: %w", version, err)
+	}
+	return nil
+}
+
+func (r *sqliteRuleVersionRepository) Get(ctx context.Context, version string) (config.Rules, error) {
+	var encoded string
+	err := r.db.QueryRowContext(ctx, `SELECT rules FROM rule_versions WHERE version = ?`, version).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return config.Rules{}, fmt.Errorf("%w: %s", ErrRuleVersionNotFound, version)
+	}
+	if err != nil {
+		return config.Rules{}, fmt.Errorf("failed to load rule version %s: %w", version, err)
+	}
+
+	var rules config.Rules
+	if err := json.Unmarshal([]byte(encoded), &rules); err != nil {
+		return config.Rules{}, fmt.Errorf("failed to decode rule version %s: %w", version, err)
+	}
+	return rules, nil
+}
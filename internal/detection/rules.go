@@ -0,0 +1,82 @@
+package detection
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jasimvs/sample-go-svc/config"
+)
+
+// BuildRules creates the rules that are not disabled in cfg, wrapping shadow rules with Shadow. cfg is expected to have passed config.Rules.Validate;
+// the only error left to report is a custom rule expression that does not compile.
+func BuildRules(cfg config.Rules, repo Repository) ([]Rule, error) {
+	var rules []Rule
+	add := func(mode string, rule Rule) {
+		if mode == config.ModeShadow {
+			rule = Shadow(rule)
+		}
+		rules = append(rules, rule)
+	}
+	if hv := cfg.HighVolume; hv.Mode != config.ModeDisabled {
+		add(hv.Mode, NewHighVolumeRule(hv.AmountThreshold, hv.Weight))
+	}
+	if fs := cfg.FrequentSmallTransactions; fs.Mode != config.ModeDisabled {
+		add(fs.Mode, NewFrequentSmallTransactionsRule(repo, fs.MaxCount, fs.ThresholdAmount, fs.Window, fs.Weight))
+	}
+	if rt := cfg.RapidTransfers; rt.Mode != config.ModeDisabled {
+		add(rt.Mode, NewRapidTransfersRule(repo, rt.MinConsecutive, rt.Window, rt.Match == "consecutive", rt.Weight))
+	}
+	if st := cfg.Structuring; st.Mode != config.ModeDisabled {
+		thresholds := make(map[string]StructuringThreshold, len(st.Types))
+		for _, t := range st.Types {
+			band := t.BandPercent
+			if band == 0 {
+				band = st.BandPercent
+			}
+			thresholds[t.Type] = StructuringThreshold{Threshold: t.Threshold, BandPercent: band}
+		}
+		add(st.Mode, NewStructuringRule(repo, thresholds, st.Window, st.Weight))
+	}
+	if va := cfg.VelocityAmount; va.Mode != config.ModeDisabled {
+		limits := make([]VelocityLimit, 0, len(va.Limits))
+		for _, limit := range va.Limits {
+			limits = append(limits, VelocityLimit{Window: limit.Window, MaxAmount: limit.MaxAmount})
+		}
+		add(va.Mode, NewVelocityAmountRule(repo, va.Types, limits, va.Weight))
+	}
+	if an := cfg.Anomaly; an.Mode != config.ModeDisabled {
+		limits := AnomalyLimits{
+			MaxZScore:          an.MaxZScore,
+			MaxPercentile:      an.MaxPercentile,
+			MinHourShare:       an.MinHourShare,
+			MaxFrequencyZScore: an.MaxFrequencyZScore,
+		}
+		add(an.Mode, NewAnomalyRule(repo, an.Lookback, an.MinHistory, limits, an.Weight))
+	}
+	if do := cfg.Dormancy; do.Mode != config.ModeDisabled {
+		add(do.Mode, NewDormancyRule(repo, do.Period, do.MinAmount, do.VelocityWindow, do.VelocityAmount, do.Weight))
+	}
+	if nf := cfg.NetworkFan; nf.Mode != config.ModeDisabled {
+		add(nf.Mode, NewNetworkFanRule(repo, nf.Window, nf.History, nf.MaxRecipients, nf.MaxSenders, nf.Weight))
+	}
+	if cf := cfg.CircularFlow; cf.Mode != config.ModeDisabled {
+		add(cf.Mode, NewCircularFlowRule(repo, cf.Window, cf.MaxHops, cf.Weight))
+	}
+
+	var errs []error
+	for i, custom := range cfg.Custom {
+		if custom.RuleMode() == config.ModeDisabled {
+			continue
+		}
+		rule, err := NewExpressionRule(repo, custom.Name, custom.Expression, custom.Weight)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("detection.rules.custom[%d]: %w", i, err))
+			continue
+		}
+		add(custom.RuleMode(), rule)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return rules, nil
+}
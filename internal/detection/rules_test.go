@@ -0,0 +1,440 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/config"
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWindowedRules_EvaluateAsOfTransaction tests that a transaction processed after later ones were
+// stored gets the same verdict as when processed on time.
+func TestWindowedRules_EvaluateAsOfTransaction(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	var stored []model.Transaction
+	for i := 0; i < 4; i++ {
+		stored = append(stored,
+			model.Transaction{ID: fmt.Sprintf("late_transfer_%d", i), UserID: "u1", Amount: 500, Type: model.TransferType, Timestamp: start.Add(time.Duration(i) * time.Minute)},
+			model.Transaction{ID: fmt.Sprintf("late_small_%d", i), UserID: "u2", Amount: 5, Type: model.DepositType, Timestamp: start.Add(time.Duration(i) * time.Minute)},
+		)
+	}
+	for _, txn := range stored {
+		insertTestData(t, db, Transaction{ID: txn.ID, UserID: txn.UserID, Amount: txn.Amount, Type: txn.Type, Timestamp: txn.Timestamp})
+	}
+	expression, err := NewExpressionRule(repo, "ManyTransfers", `count(1h, type == "transfer") >= 3`, 50)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		rule  Rule
+		first model.Transaction // Only the first in the window; the ones after it must not count
+		last  model.Transaction
+	}{
+		{"rapid transfers", NewRapidTransfersRule(repo, 3, 5*time.Minute, true, 60), stored[0], stored[6]},
+		{"frequent small transactions", NewFrequentSmallTransactionsRule(repo, 2, 100, time.Hour, 50), stored[1], stored[7]},
+		{"expression", expression, stored[0], stored[6]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.rule.DetectSuspiciousActivity(tt.first)
+			require.NoError(t, err)
+			assert.Zero(t, result.Score, "Transactions after %s were counted", tt.first.ID)
+
+			result, err = tt.rule.DetectSuspiciousActivity(tt.last)
+			require.NoError(t, err)
+			assert.Positive(t, result.Score)
+		})
+	}
+}
+
+// TestRapidTransfersRule_Match tests that an interleaved deposit breaks a consecutive sequence, but not an "any" one.
+func TestRapidTransfersRule_Match(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	history := []Transaction{
+		{ID: "rt_1", Type: model.TransferType},
+		{ID: "rt_2", Type: model.TransferType},
+		{ID: "rt_deposit", Type: model.DepositType},
+		{ID: "rt_3", Type: model.TransferType},
+		{ID: "rt_4", Type: model.TransferType},
+	}
+	for i := range history {
+		history[i].UserID, history[i].Amount, history[i].Timestamp = "u1", 100, start.Add(time.Duration(i)*time.Minute)
+		insertTestData(t, db, history[i])
+	}
+	last := history[len(history)-1]
+	txn := model.Transaction{ID: last.ID, UserID: last.UserID, Amount: last.Amount, Type: last.Type, Timestamp: last.Timestamp}
+
+	result, err := NewRapidTransfersRule(repo, 3, 5*time.Minute, true, 60).DetectSuspiciousActivity(txn)
+	require.NoError(t, err)
+	assert.Zero(t, result.Score, "The deposit breaks the sequence")
+
+	result, err = NewRapidTransfersRule(repo, 2, 5*time.Minute, true, 60).DetectSuspiciousActivity(txn)
+	require.NoError(t, err)
+	require.Positive(t, result.Score)
+	assert.Equal(t, []string{"rt_4", "rt_3"}, result.Evidence.RelatedTransactionIDs)
+
+	result, err = NewRapidTransfersRule(repo, 3, 5*time.Minute, false, 60).DetectSuspiciousActivity(txn)
+	require.NoError(t, err)
+	require.Positive(t, result.Score)
+	assert.Equal(t, []string{"rt_4", "rt_3", "rt_2", "rt_1"}, result.Evidence.RelatedTransactionIDs)
+}
+
+// TestStructuringRule tests that amounts just below a type's threshold are flagged once they add up to
+// more than it, and that other types, amounts and old transactions are not counted.
+func TestStructuringRule(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	history := []Transaction{
+		{ID: "st_old", UserID: "u1", Amount: 9500, Type: model.DepositType, Timestamp: start.Add(-80 * time.Hour)},
+		{ID: "st_1", UserID: "u1", Amount: 9500, Type: model.DepositType, Timestamp: start},
+		{ID: "st_small", UserID: "u1", Amount: 5000, Type: model.DepositType, Timestamp: start.Add(time.Hour)},
+		{ID: "st_withdrawal", UserID: "u1", Amount: 9500, Type: model.WithdrawalType, Timestamp: start.Add(2 * time.Hour)},
+		{ID: "st_2", UserID: "u1", Amount: 9600, Type: model.DepositType, Timestamp: start.Add(24 * time.Hour)},
+		{ID: "st_transfer_1", UserID: "u1", Amount: 4100, Type: model.TransferType, Timestamp: start.Add(25 * time.Hour)},
+		{ID: "st_transfer_2", UserID: "u1", Amount: 4200, Type: model.TransferType, Timestamp: start.Add(26 * time.Hour)},
+	}
+	txns := seedTransactions(t, db, history)
+	rule := NewStructuringRule(repo, map[string]StructuringThreshold{
+		model.DepositType:    {Threshold: 10000, BandPercent: 10},
+		model.WithdrawalType: {Threshold: 10000, BandPercent: 10},
+		model.TransferType:   {Threshold: 5000, BandPercent: 20},
+	}, 72*time.Hour, 60)
+
+	tests := []struct {
+		txn     string
+		related []string // Empty when not flagged
+	}{
+		{"st_1", nil},          // st_old is outside the window
+		{"st_small", nil},      // Not just below the threshold
+		{"st_withdrawal", nil}, // The deposits are another type
+		{"st_2", []string{"st_2", "st_1"}},
+		{"st_transfer_2", []string{"st_transfer_2", "st_transfer_1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.txn, func(t *testing.T) {
+			result, err := rule.DetectSuspiciousActivity(txns[tt.txn])
+			require.NoError(t, err)
+			if tt.related == nil {
+				assert.Zero(t, result.Score)
+				return
+			}
+			require.Equal(t, 60.0, result.Score)
+			assert.Equal(t, tt.related, result.Evidence.RelatedTransactionIDs)
+		})
+	}
+}
+
+// TestVelocityAmountRule tests that the sum of the configured types is checked against every window,
+// and that the shortest breached window is the one reported.
+func TestVelocityAmountRule(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	history := []Transaction{
+		{ID: "va_old", UserID: "u1", Amount: 9000, Type: model.WithdrawalType, Timestamp: start.Add(-48 * time.Hour)},
+		{ID: "va_1", UserID: "u1", Amount: 3000, Type: model.WithdrawalType, Timestamp: start},
+		{ID: "va_deposit", UserID: "u1", Amount: 9000, Type: model.DepositType, Timestamp: start.Add(10 * time.Minute)},
+		{ID: "va_2", UserID: "u1", Amount: 3000, Type: model.TransferType, Timestamp: start.Add(20 * time.Minute)},
+		{ID: "va_3", UserID: "u1", Amount: 3000, Type: model.TransferType, Timestamp: start.Add(2 * time.Hour)},
+	}
+	txns := seedTransactions(t, db, history)
+	limits := []VelocityLimit{{Window: 24 * time.Hour, MaxAmount: 8000}, {Window: time.Hour, MaxAmount: 5000}}
+	rule := NewVelocityAmountRule(repo, []string{model.WithdrawalType, model.TransferType}, limits, 50)
+
+	result, err := rule.DetectSuspiciousActivity(txns["va_1"])
+	require.NoError(t, err)
+	assert.Zero(t, result.Score, "va_old is outside both windows")
+
+	result, err = rule.DetectSuspiciousActivity(txns["va_deposit"])
+	require.NoError(t, err)
+	assert.Zero(t, result.Score, "Deposits are not checked")
+
+	result, err = rule.DetectSuspiciousActivity(txns["va_2"])
+	require.NoError(t, err)
+	require.Equal(t, 50.0, result.Score)
+	assert.Equal(t, &Evidence{Threshold: 5000, Observed: 6000, Window: "1h0m0s", RelatedTransactionIDs: []string{"va_2", "va_1"}}, result.Evidence)
+
+	result, err = rule.DetectSuspiciousActivity(txns["va_3"])
+	require.NoError(t, err)
+	require.Equal(t, 50.0, result.Score)
+	assert.Equal(t, "24h0m0s", result.Evidence.Window, "Only the 24h limit is breached")
+	assert.Equal(t, 9000.0, result.Evidence.Observed)
+}
+
+// TestAnomalyRule tests each check against a user with a steady history, and that users without
+// enough history are not checked.
+func TestAnomalyRule(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	for day := 0; day < 25; day++ {
+		insertTestData(t, db, Transaction{ID: fmt.Sprintf("an_%d", day), UserID: "u1", Amount: float64(90 + day%3*10), Type: model.DepositType, Timestamp: start.Add(time.Duration(day) * 24 * time.Hour)})
+	}
+	for i := 0; i < 5; i++ {
+		insertTestData(t, db, Transaction{ID: fmt.Sprintf("an_new_%d", i), UserID: "u2", Amount: 100, Type: model.DepositType, Timestamp: start.Add(time.Duration(i) * time.Hour)})
+	}
+	now := start.Add(25 * 24 * time.Hour)
+
+	profile, err := repo.Profile(context.Background(), "u1", now.Add(-30*24*time.Hour), now)
+	require.NoError(t, err)
+	assert.Equal(t, 25, profile.Transactions)
+	assert.InDelta(t, 99.6, profile.Types[model.DepositType].Mean, 0.001)
+	assert.InDelta(t, 8.24, profile.Types[model.DepositType].StdDev, 0.01)
+	assert.Equal(t, 1.0, profile.HourShare[10])
+	assert.InDelta(t, 25.0/30, profile.DailyMean, 0.001)
+
+	deposit := func(id string, amount float64, at time.Time) model.Transaction {
+		return model.Transaction{ID: id, UserID: "u1", Amount: amount, Type: model.DepositType, Timestamp: at}
+	}
+	tests := []struct {
+		name    string
+		limits  AnomalyLimits
+		txn     model.Transaction
+		flagged bool
+	}{
+		{"usual amount", AnomalyLimits{MaxZScore: 4}, deposit("t1", 110, now), false},
+		{"large amount", AnomalyLimits{MaxZScore: 4}, deposit("t2", 5000, now), true},
+		{"no history of the type", AnomalyLimits{MaxZScore: 4}, model.Transaction{ID: "t3", UserID: "u1", Amount: 5000, Type: model.WithdrawalType, Timestamp: now}, false},
+		{"above every amount", AnomalyLimits{MaxPercentile: 99}, deposit("t4", 111, now), true},
+		{"usual hour", AnomalyLimits{MinHourShare: 2}, deposit("t5", 100, now.Add(30*time.Minute)), false},
+		{"unusual hour", AnomalyLimits{MinHourShare: 2}, deposit("t6", 100, now.Add(-7*time.Hour)), true},
+		{"new user", AnomalyLimits{MaxZScore: 4}, model.Transaction{ID: "t7", UserID: "u2", Amount: 50000, Type: model.DepositType, Timestamp: now}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewAnomalyRule(repo, 30*24*time.Hour, 20, tt.limits, 40).DetectSuspiciousActivity(tt.txn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.flagged, result.Score > 0, result.Reason)
+		})
+	}
+
+	t.Run("burst of transactions", func(t *testing.T) {
+		rule := NewAnomalyRule(repo, 30*24*time.Hour, 20, AnomalyLimits{MaxFrequencyZScore: 3}, 40)
+		burstStart := now.Add(12 * time.Hour) // More than a day after the last deposit
+		var result Result
+		for i := 0; i < 6; i++ {
+			txn := deposit(fmt.Sprintf("an_burst_%d", i), 100, burstStart.Add(time.Duration(i)*time.Minute))
+			insertTestData(t, db, Transaction{ID: txn.ID, UserID: txn.UserID, Amount: txn.Amount, Type: txn.Type, Timestamp: txn.Timestamp})
+			result, err = rule.DetectSuspiciousActivity(txn)
+			require.NoError(t, err)
+			if i < 3 {
+				assert.Zero(t, result.Score, "Transaction %d of the day", i+1)
+			}
+		}
+		assert.Equal(t, 40.0, result.Score, "6 transactions in a day against less than one a day")
+	})
+}
+
+// TestDormancyRule tests that only accounts with an earlier transaction before the dormancy period,
+// and none since, are flagged, for one large amount or for the total moved within the velocity window.
+func TestDormancyRule(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	longAgo := start.Add(-200 * 24 * time.Hour)
+	history := []Transaction{
+		{ID: "do_old_1", UserID: "u1", Amount: 100, Type: model.WithdrawalType, Timestamp: longAgo},
+		{ID: "do_large", UserID: "u1", Amount: 6000, Type: model.WithdrawalType, Timestamp: start},
+		{ID: "do_old_2", UserID: "u2", Amount: 100, Type: model.WithdrawalType, Timestamp: longAgo},
+		{ID: "do_burst_1", UserID: "u2", Amount: 4000, Type: model.WithdrawalType, Timestamp: start},
+		{ID: "do_burst_2", UserID: "u2", Amount: 4000, Type: model.WithdrawalType, Timestamp: start.Add(time.Hour)},
+		{ID: "do_burst_3", UserID: "u2", Amount: 4000, Type: model.WithdrawalType, Timestamp: start.Add(2 * time.Hour)},
+		{ID: "do_recent", UserID: "u3", Amount: 100, Type: model.WithdrawalType, Timestamp: start.Add(-10 * 24 * time.Hour)},
+		{ID: "do_active", UserID: "u3", Amount: 6000, Type: model.WithdrawalType, Timestamp: start},
+		{ID: "do_new", UserID: "u4", Amount: 6000, Type: model.WithdrawalType, Timestamp: start},
+		{ID: "do_past_period", UserID: "u5", Amount: 100, Type: model.WithdrawalType, Timestamp: start.Add(-90*24*time.Hour - 12*time.Hour)},
+		{ID: "do_just_dormant", UserID: "u5", Amount: 6000, Type: model.WithdrawalType, Timestamp: start},
+		{ID: "do_within_period", UserID: "u6", Amount: 100, Type: model.WithdrawalType, Timestamp: start.Add(-90*24*time.Hour + 12*time.Hour)},
+		{ID: "do_not_dormant", UserID: "u6", Amount: 6000, Type: model.WithdrawalType, Timestamp: start},
+	}
+	txns := seedTransactions(t, db, history)
+	rule := NewDormancyRule(repo, 90*24*time.Hour, 5000, 24*time.Hour, 10000, 50)
+
+	tests := []struct {
+		txn     string
+		related []string // Empty when not flagged
+	}{
+		{"do_large", []string{"do_large", "do_old_1"}},
+		{"do_burst_1", nil},
+		{"do_burst_3", []string{"do_burst_3", "do_burst_2", "do_burst_1", "do_old_2"}},
+		{"do_active", nil},
+		{"do_new", nil},
+		{"do_just_dormant", []string{"do_just_dormant", "do_past_period"}},
+		{"do_not_dormant", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.txn, func(t *testing.T) {
+			result, err := rule.DetectSuspiciousActivity(txns[tt.txn])
+			require.NoError(t, err)
+			if tt.related == nil {
+				assert.Zero(t, result.Score, result.Reason)
+				return
+			}
+			require.Equal(t, 50.0, result.Score)
+			assert.Equal(t, tt.related, result.Evidence.RelatedTransactionIDs)
+		})
+	}
+}
+
+// TestNetworkFanRule tests fan-out to new counterparties and fan-in from many senders, with the
+// counterparties and their transfers in the evidence.
+func TestNetworkFanRule(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	history := []Transaction{
+		{ID: "nf_known", UserID: "u1", Amount: 100, Type: model.TransferType, CounterpartyID: "old", Timestamp: start.Add(-10 * 24 * time.Hour)},
+		{ID: "nf_out_old", UserID: "u1", Amount: 100, Type: model.TransferType, CounterpartyID: "old", Timestamp: start},
+		{ID: "nf_out_1", UserID: "u1", Amount: 100, Type: model.TransferType, CounterpartyID: "r1", Timestamp: start.Add(time.Minute)},
+		{ID: "nf_out_2", UserID: "u1", Amount: 100, Type: model.TransferType, CounterpartyID: "r2", Timestamp: start.Add(2 * time.Minute)},
+		{ID: "nf_out_3", UserID: "u1", Amount: 100, Type: model.TransferType, CounterpartyID: "r3", Timestamp: start.Add(3 * time.Minute)},
+		{ID: "nf_in_1", UserID: "s1", Amount: 100, Type: model.TransferType, CounterpartyID: "mule", Timestamp: start},
+		{ID: "nf_in_2", UserID: "s2", Amount: 100, Type: model.TransferType, CounterpartyID: "mule", Timestamp: start.Add(time.Minute)},
+		{ID: "nf_in_3", UserID: "s3", Amount: 100, Type: model.TransferType, CounterpartyID: "mule", Timestamp: start.Add(2 * time.Minute)},
+	}
+	txns := seedTransactions(t, db, history)
+
+	t.Run("fan-out", func(t *testing.T) {
+		rule := NewNetworkFanRule(repo, 24*time.Hour, 30*24*time.Hour, 3, 0, 60)
+		result, err := rule.DetectSuspiciousActivity(txns["nf_out_3"])
+		require.NoError(t, err)
+		assert.Zero(t, result.Score, "The counterparty paid 10 days ago is not new")
+
+		rule = NewNetworkFanRule(repo, 24*time.Hour, 0, 3, 0, 60)
+		result, err = rule.DetectSuspiciousActivity(txns["nf_out_3"])
+		require.NoError(t, err)
+		require.Equal(t, 60.0, result.Score)
+		assert.Equal(t, []string{"r3", "r2", "r1", "old"}, result.Evidence.Counterparties)
+		assert.Equal(t, []string{"nf_out_3", "nf_out_2", "nf_out_1", "nf_out_old"}, result.Evidence.RelatedTransactionIDs)
+
+		rule = NewNetworkFanRule(repo, 24*time.Hour, 30*24*time.Hour, 2, 0, 60)
+		result, err = rule.DetectSuspiciousActivity(txns["nf_out_3"])
+		require.NoError(t, err)
+		require.Equal(t, 60.0, result.Score)
+		assert.Equal(t, []string{"r3", "r2", "r1"}, result.Evidence.Counterparties)
+		assert.Equal(t, []string{"nf_out_3", "nf_out_2", "nf_out_1"}, result.Evidence.RelatedTransactionIDs)
+	})
+
+	t.Run("fan-in", func(t *testing.T) {
+		rule := NewNetworkFanRule(repo, 24*time.Hour, 0, 0, 2, 60)
+		result, err := rule.DetectSuspiciousActivity(txns["nf_in_2"])
+		require.NoError(t, err)
+		assert.Zero(t, result.Score, "nf_in_3 is later")
+
+		result, err = rule.DetectSuspiciousActivity(txns["nf_in_3"])
+		require.NoError(t, err)
+		require.Equal(t, 60.0, result.Score)
+		assert.Equal(t, []string{"s3", "s2", "s1"}, result.Evidence.Counterparties)
+		assert.Equal(t, []string{"nf_in_3", "nf_in_2", "nf_in_1"}, result.Evidence.RelatedTransactionIDs)
+	})
+}
+
+// TestCircularFlowRule tests that a transfer closing a circle of earlier transfers is flagged, within the
+// time order, hop limit, window and search budget, and the subgraph around a user.
+func TestCircularFlowRule(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	start := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	history := []Transaction{
+		{ID: "cf_back", UserID: "u2", Amount: 1000, Type: model.TransferType, CounterpartyID: "u1", Timestamp: start.Add(-time.Hour)},
+		{ID: "cf_1", UserID: "u1", Amount: 1000, Type: model.TransferType, CounterpartyID: "u2", Timestamp: start},
+		{ID: "cf_other", UserID: "u4", Amount: 1000, Type: model.TransferType, CounterpartyID: "u3", Timestamp: start.Add(30 * time.Minute)},
+		{ID: "cf_2", UserID: "u2", Amount: 1000, Type: model.TransferType, CounterpartyID: "u3", Timestamp: start.Add(time.Hour)},
+		{ID: "cf_3", UserID: "u3", Amount: 1000, Type: model.TransferType, CounterpartyID: "u1", Timestamp: start.Add(2 * time.Hour)},
+	}
+	txns := seedTransactions(t, db, history)
+
+	rule := NewCircularFlowRule(repo, 24*time.Hour, 4, 70)
+	result, err := rule.DetectSuspiciousActivity(txns["cf_3"])
+	require.NoError(t, err)
+	require.Equal(t, 70.0, result.Score)
+	assert.Equal(t, []string{"u1", "u2", "u3"}, result.Evidence.Counterparties)
+	assert.Equal(t, []string{"cf_3", "cf_2", "cf_1"}, result.Evidence.RelatedTransactionIDs)
+	assert.Equal(t, 3.0, result.Evidence.Observed)
+
+	result, err = rule.DetectSuspiciousActivity(txns["cf_back"])
+	require.NoError(t, err)
+	assert.Zero(t, result.Score, "u1 paid u2 only after cf_back")
+
+	result, err = NewCircularFlowRule(repo, 24*time.Hour, 2, 70).DetectSuspiciousActivity(txns["cf_3"])
+	require.NoError(t, err)
+	assert.Zero(t, result.Score, "The circle has 3 hops")
+
+	result, err = NewCircularFlowRule(repo, 90*time.Minute, 4, 70).DetectSuspiciousActivity(txns["cf_3"])
+	require.NoError(t, err)
+	assert.Zero(t, result.Score, "cf_1 is outside the window")
+
+	// A cycle through a counterparty with more incoming transfers than the search budget is given up on.
+	sqlTx, err := db.Begin()
+	require.NoError(t, err)
+	for i := 0; i <= maxCycleEdges; i++ {
+		_, err := sqlTx.Exec(`INSERT INTO transactions (id, user_id, amount, type, timestamp, counterparty_id) VALUES (?, ?, ?, ?, ?, ?)`,
+			fmt.Sprintf("cf_hub_%d", i), fmt.Sprintf("payer_%d", i), 10.0, model.TransferType, start.Add(time.Duration(i)*time.Second), "hub")
+		require.NoError(t, err)
+	}
+	require.NoError(t, sqlTx.Commit())
+	insertTestData(t, db, Transaction{ID: "cf_to_hub", UserID: "u5", CounterpartyID: "hub", Amount: 1000, Type: model.TransferType, Timestamp: start.Add(time.Hour)})
+	fromHub := model.Transaction{ID: "cf_from_hub", UserID: "hub", CounterpartyID: "u5", Amount: 1000, Type: model.TransferType, Timestamp: start.Add(2 * time.Hour)}
+	result, err = rule.DetectSuspiciousActivity(fromHub)
+	require.NoError(t, err, "Running out of budget is not an error")
+	assert.Zero(t, result.Score)
+
+	graph := NewTransferGraph(repo)
+	neighborhood, err := graph.Neighborhood(context.Background(), "u1", start.Add(-24*time.Hour), start.Add(24*time.Hour), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"u1", "u2", "u3"}, neighborhood.Nodes)
+	assert.Equal(t, []string{"cf_back", "cf_1", "cf_3"}, edgeIDs(neighborhood.Edges))
+
+	neighborhood, err = graph.Neighborhood(context.Background(), "u1", start.Add(-24*time.Hour), start.Add(24*time.Hour), 2)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"u1", "u2", "u3", "u4"}, neighborhood.Nodes)
+	assert.Equal(t, []string{"cf_back", "cf_1", "cf_other", "cf_2", "cf_3"}, edgeIDs(neighborhood.Edges))
+	assert.False(t, neighborhood.Truncated)
+}
+
+func edgeIDs(edges []Edge) []string {
+	ids := make([]string, len(edges))
+	for i, edge := range edges {
+		ids[i] = edge.TransactionID
+	}
+	return ids
+}
+
+// TestBuildRules_BuiltInRuleNames tests that config.BuiltInRuleNames, which custom rules cannot use, names every built-in rule.
+func TestBuildRules_BuiltInRuleNames(t *testing.T) {
+	_, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+
+	cfg, err := config.ParseRules("yaml", strings.NewReader(""))
+	require.NoError(t, err)
+	for _, mode := range []*string{&cfg.HighVolume.Mode, &cfg.FrequentSmallTransactions.Mode, &cfg.RapidTransfers.Mode, &cfg.Structuring.Mode,
+		&cfg.VelocityAmount.Mode, &cfg.Anomaly.Mode, &cfg.Dormancy.Mode, &cfg.NetworkFan.Mode, &cfg.CircularFlow.Mode} {
+		*mode = config.ModeEnforce
+	}
+	rules, err := BuildRules(cfg, repo)
+	require.NoError(t, err)
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.Name()
+	}
+	assert.ElementsMatch(t, config.BuiltInRuleNames, names)
+}
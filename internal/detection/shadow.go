@@ -0,0 +1,135 @@
+package detection
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/config"
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+// ShadowRule runs a rule in observe-only mode: the Manager evaluates it and records its hits in the
+// shadow_hits table, but they never affect the risk score or suspicion status.
+type ShadowRule struct {
+	rule Rule
+}
+
+func Shadow(rule Rule) *ShadowRule {
+	return &ShadowRule{rule: rule}
+}
+
+func (r *ShadowRule) Name() string {
+	return r.rule.Name()
+}
+
+func (r *ShadowRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	return r.rule.DetectSuspiciousActivity(txn)
+}
+
+// RuleHitRate is how often a rule matched the transactions analyzed in a period.
+type RuleHitRate struct {
+	Rule      string  `json:"rule"`
+	Mode      string  `json:"mode"` // enforce or shadow
+	Hits      int     `json:"hits"`
+	Evaluated int     `json:"evaluated"`
+	HitRate   float64 `json:"hit_rate"`
+}
+
+// RuleStatsRepository reports rule hit rates. Enforced hits come from the transactions' risk factors
+// and shadow hits from the shadow_hits table, which UpdateSuspicionStatus writes.
+type RuleStatsRepository interface {
+	Migrate(ctx context.Context) error
+	HitRates(ctx context.Context, since time.Time) ([]RuleHitRate, error)
+}
+
+type sqliteRuleStatsRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteRuleStatsRepository(db *sql.DB) RuleStatsRepository {
+	if db == nil {
+		panic("database connection (*sql.DB) is required for NewSQLiteRuleStatsRepository")
+	}
+	return &sqliteRuleStatsRepository{db: db}
+}
+
+func (r *sqliteRuleStatsRepository) Migrate(ctx context.Context) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS shadow_hits (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        transaction_id TEXT NOT NULL,
+        rule TEXT NOT NULL,
+        score REAL NOT NULL,
+        reason TEXT NOT NULL,
+        evidence TEXT,
+        created_at TIMESTAMP NOT NULL,
+        UNIQUE (transaction_id, rule)
+    );`
+	if _, err := r.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create shadow_hits table: %w", err)
+	}
+	if _, err := r.db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_shadow_hits_created_at ON shadow_hits(created_at);`); err != nil {
+		return fmt.Errorf("failed to index shadow_hits table: %w", err)
+	}
+	return nil
+}
+
+// HitRates compares every rule that matched a transaction analyzed since the given time. A rule
+// that moved from shadow to enforce within the period is listed once per mode.
+func (r *sqliteRuleStatsRepository) HitRates(ctx context.Context, since time.Time) ([]RuleHitRate, error) {
+	var evaluated int
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM transactions WHERE analyzed_at >= ?`, since).Scan(&evaluated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count analyzed transactions: %w", err)
+	}
+
+	enforcedQuery := `SELECT json_extract(f.value, '$.rule') AS rule, COUNT(*) FROM transactions t, json_each(t.risk_factors) f
+		WHERE t.analyzed_at >= ? AND json_type(t.risk_factors) = 'array' GROUP BY rule ORDER BY rule`
+	shadowQuery := `SELECT rule, COUNT(*) FROM shadow_hits WHERE created_at >= ? GROUP BY rule ORDER BY rule`
+
+	hitRates := make([]RuleHitRate, 0)
+	for _, q := range []struct{ mode, query string }{{config.ModeEnforce, enforcedQuery}, {config.ModeShadow, shadowQuery}} {
+		rows, err := r.db.QueryContext(ctx, q.query, since)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s rule hits: %w", q.mode, err)
+		}
+		for rows.Next() {
+			hitRate := RuleHitRate{Mode: q.mode, Evaluated: evaluated}
+			if err := rows.Scan(&hitRate.Rule, &hitRate.Hits); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan %s rule hits: %w", q.mode, err)
+			}
+			if evaluated > 0 {
+				hitRate.HitRate = float64(hitRate.Hits) / float64(evaluated)
+			}
+			hitRates = append(hitRates, hitRate)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error iterating %s rule hits: %w", q.mode, err)
+		}
+	}
+	return hitRates, nil
+}
+
+// insertShadowHits replaces the shadow hits of a transaction, so a retried detection is not counted twice.
+func insertShadowHits(ctx context.Context, sqlTx *sql.Tx, transactionID string, hits []RiskFactor, now time.Time) error {
+	if _, err := sqlTx.ExecContext(ctx, `DELETE FROM shadow_hits WHERE transaction_id = ?`, transactionID); err != nil {
+		return fmt.Errorf("failed to clear shadow hits of transaction %s: %w", transactionID, err)
+	}
+	query := `INSERT INTO shadow_hits (transaction_id, rule, score, reason, evidence, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	for _, hit := range hits {
+		evidence, err := json.Marshal(hit.Evidence)
+		if err != nil {
+			return fmt.Errorf("failed to encode shadow hit evidence of transaction %s: %w", transactionID, err)
+		}
+		if _, err := sqlTx.ExecContext(ctx, query, transactionID, hit.Rule, hit.Score, hit.Reason, string(evidence), now); err != nil {
+			return fmt.Errorf("failed to store shadow hit of rule %s on transaction %s: %w", hit.Rule, transactionID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package detection
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingRule always fails, to check that a broken shadow rule does not fail detection.
+type failingRule struct{}
+
+func (failingRule) Name() string { return "Failing" }
+
+func (failingRule) DetectSuspiciousActivity(model.Transaction) (Result, error) {
+	return Result{}, errors.New("boom")
+}
+
+// TestManager_ShadowRules tests that shadow hits are recorded without affecting the verdict, and show up in the hit rates.
+func TestManager_ShadowRules(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	txns := []model.Transaction{
+		{ID: "shadow_big", UserID: "u1", Amount: 20000, Type: model.DepositType, Timestamp: now},
+		{ID: "shadow_huge", UserID: "u1", Amount: 60000, Type: model.DepositType, Timestamp: now},
+		{ID: "shadow_small", UserID: "u1", Amount: 10, Type: model.DepositType, Timestamp: now},
+	}
+
+	manager := NewManager(repo)
+	manager.SetRules("test", []Rule{
+		NewHighVolumeRule(50000, 70),
+		Shadow(NewHighVolumeRule(10000, 70)),
+		Shadow(failingRule{}),
+	}, DefaultRiskBands)
+
+	for _, txn := range txns {
+		insertTestData(t, db, Transaction{ID: txn.ID, UserID: txn.UserID, Amount: txn.Amount, Type: txn.Type, Timestamp: txn.Timestamp})
+		require.NoError(t, manager.Process(ctx, txn))
+	}
+
+	suspicious := true
+	flagged, err := repo.Get(ctx, Filter{IsSuspicious: &suspicious})
+	require.NoError(t, err)
+	require.Len(t, flagged, 1, "Shadow hits must not flag transactions")
+	assert.Equal(t, "shadow_huge", flagged[0].ID)
+	assert.Equal(t, 70.0, flagged[0].RiskScore)
+
+	hitRates, err := NewSQLiteRuleStatsRepository(db).HitRates(ctx, now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []RuleHitRate{
+		{Rule: highVolumeRuleName, Mode: "enforce", Hits: 1, Evaluated: 3, HitRate: 1.0 / 3},
+		{Rule: highVolumeRuleName, Mode: "shadow", Hits: 2, Evaluated: 3, HitRate: 2.0 / 3},
+	}, hitRates)
+}
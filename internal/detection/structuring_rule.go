@@ -0,0 +1,93 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+const structuringRuleName = "Structuring"
+
+// StructuringThreshold is the reporting threshold of a transaction type, and how far below it, in
+// percent, an amount counts as structured.
+type StructuringThreshold struct {
+	Threshold   float64
+	BandPercent float64
+}
+
+// StructuringRule flags a transaction just below its type's reporting threshold when, together with
+// the user's other such transactions of that type in the window, it adds up to more than the threshold,
+// e.g. several 9,500 deposits against a 10,000 threshold.
+type StructuringRule struct {
+	repo           Repository
+	thresholds     map[string]StructuringThreshold // By transaction type
+	windowDuration time.Duration
+	weight         float64
+}
+
+func NewStructuringRule(repo Repository, thresholds map[string]StructuringThreshold, windowDuration time.Duration, weight float64) *StructuringRule {
+	if repo == nil {
+		panic("Repository cannot be nil for StructuringRule")
+	}
+	return &StructuringRule{
+		repo:           repo,
+		thresholds:     thresholds,
+		windowDuration: windowDuration,
+		weight:         weight,
+	}
+}
+
+func (r *StructuringRule) Name() string {
+	return structuringRuleName
+}
+
+func (r *StructuringRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	limit, ok := r.thresholds[txn.Type]
+	if !ok {
+		return Result{}, nil
+	}
+	bandStart := limit.Threshold * (1 - limit.BandPercent/100)
+	if txn.Amount < bandStart || txn.Amount >= limit.Threshold {
+		return Result{}, nil
+	}
+
+	windowStart := txn.Timestamp.Add(-r.windowDuration)
+
+	filters := Filter{
+		UserID:         txn.UserID,
+		Type:           txn.Type,
+		AmountAtLeast:  &bandStart,
+		AmountLessThan: &limit.Threshold,
+		Since:          &windowStart,
+		Until:          &txn.Timestamp,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	total, err := r.repo.Sum(ctx, filters)
+	if err != nil {
+		return Result{}, err
+	}
+	if total <= limit.Threshold {
+		return Result{}, nil
+	}
+
+	// Only load the transactions for the evidence, most evaluations stop at the sum.
+	cluster, err := r.repo.Get(ctx, filters)
+	if err != nil {
+		return Result{}, err
+	}
+	ids := transactionIDs(cluster)
+	reason := fmt.Sprintf("%d %s transactions between %.2f and %.2f within %s sum to %.2f, above %.2f: %s",
+		len(cluster), txn.Type, bandStart, limit.Threshold, r.windowDuration, total, limit.Threshold, summarizeIDs(ids))
+	evidence := &Evidence{
+		Threshold:             limit.Threshold,
+		Observed:              total,
+		Window:                r.windowDuration.String(),
+		RelatedTransactionIDs: ids,
+	}
+	return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
+}
@@ -0,0 +1,94 @@
+package detection
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+const velocityAmountRuleName = "VelocityAmount"
+
+// VelocityLimit is the most a user may move within Window.
+type VelocityLimit struct {
+	Window    time.Duration
+	MaxAmount float64
+}
+
+// VelocityAmountRule caps the total amount of a user's transactions of the given types over rolling
+// windows, where FrequentSmallTransactionsRule only counts them.
+type VelocityAmountRule struct {
+	repo   Repository
+	types  []string
+	limits []VelocityLimit // Shortest window first
+	weight float64
+}
+
+func NewVelocityAmountRule(repo Repository, types []string, limits []VelocityLimit, weight float64) *VelocityAmountRule {
+	if repo == nil {
+		panic("Repository cannot be nil for VelocityAmountRule")
+	}
+	limits = slices.Clone(limits)
+	slices.SortFunc(limits, func(a, b VelocityLimit) int { return cmp.Compare(a.Window, b.Window) })
+	return &VelocityAmountRule{
+		repo:   repo,
+		types:  types,
+		limits: limits,
+		weight: weight,
+	}
+}
+
+func (r *VelocityAmountRule) Name() string {
+	return velocityAmountRuleName
+}
+
+func (r *VelocityAmountRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	if !slices.Contains(r.types, txn.Type) {
+		return Result{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The shortest breached window is reported; the longer ones are mentioned in the reason.
+	var breached []string
+	var evidence *Evidence
+	var filters Filter
+	for _, limit := range r.limits {
+		windowStart := txn.Timestamp.Add(-limit.Window)
+		windowFilters := Filter{
+			UserID: txn.UserID,
+			Types:  r.types,
+			Since:  &windowStart,
+			Until:  &txn.Timestamp,
+		}
+		total, err := r.repo.Sum(ctx, windowFilters)
+		if err != nil {
+			return Result{}, err
+		}
+		if total <= limit.MaxAmount {
+			continue
+		}
+		breached = append(breached, fmt.Sprintf("%.2f within %s, above %.2f", total, limit.Window, limit.MaxAmount))
+		if evidence == nil {
+			evidence = &Evidence{Threshold: limit.MaxAmount, Observed: total, Window: limit.Window.String()}
+			filters = windowFilters
+		}
+	}
+	if evidence == nil {
+		return Result{}, nil
+	}
+
+	// Only load the transactions for the evidence, most evaluations stop at the sums.
+	moved, err := r.repo.Get(ctx, filters)
+	if err != nil {
+		return Result{}, err
+	}
+	evidence.RelatedTransactionIDs = transactionIDs(moved)
+	reason := fmt.Sprintf("%s moved %s: %s", strings.Join(r.types, "/"), strings.Join(breached, "; "), summarizeIDs(evidence.RelatedTransactionIDs))
+	return Result{Score: r.weight, Reason: reason, Evidence: evidence}, nil
+}
@@ -0,0 +1,323 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+// WindowStore keeps each user's recent transactions in memory, so the windowed rules do not need a
+// SQL query per evaluated transaction. It wraps a Repository: Get, Count, Sum and AggregateByBucket
+// answer per-user window queries (UserID with any of Type, Types, CounterpartyID, AmountLessThan,
+// AmountAtLeast, Since, Until and Before) from memory when the window is within the last retention
+// period and the store has been warmed, and pass everything else, including writes, through to the
+// wrapped Repository. Windows bounded only by time are counted and summed from running totals, the
+// others by scanning just the window.
+//
+// It also keeps the profiles of the users rules ask for up to date, see Profile.
+//
+// The Manager adds every transaction it processes, see Observe. A transaction that has been stored
+// but not processed yet, e.g. one waiting for a retry, is not seen by rules answered from memory.
+// Transactions answered from memory carry no verdict.
+type WindowStore struct {
+	Repository
+	retention time.Duration
+
+	mu         sync.RWMutex
+	warmed     bool
+	warmedFrom time.Time // Nothing before this was loaded; older windows go to SQL
+	users      map[string]*userWindow
+	profiles   map[string]*rollingProfile
+	lastSweep  time.Time
+}
+
+// userWindow is one user's transactions, oldest first, with their running totals, so the count and sum
+// of a window bounded only by time take two binary searches and no scan.
+type userWindow struct {
+	txns []Transaction
+	sums []float64 // sums[i] is the total amount of txns[:i]
+}
+
+// transactionObserver is implemented by repositories that need to see every processed transaction,
+// see WindowStore.
+type transactionObserver interface {
+	Observe(txn model.Transaction)
+}
+
+func NewWindowStore(repo Repository, retention time.Duration) *WindowStore {
+	if repo == nil {
+		panic("Repository cannot be nil for WindowStore")
+	}
+	return &WindowStore{
+		Repository: repo,
+		retention:  retention,
+		users:      make(map[string]*userWindow),
+		profiles:   make(map[string]*rollingProfile),
+	}
+}
+
+// Warm loads the transactions of the last retention period. Until it is called every query goes to SQL.
+func (s *WindowStore) Warm(ctx context.Context) error {
+	from := time.Now().UTC().Add(-s.retention)
+	txns, err := s.Repository.Get(ctx, Filter{Since: &from})
+	if err != nil {
+		return fmt.Errorf("failed to warm window store: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make(map[string]*userWindow)
+	s.profiles = make(map[string]*rollingProfile)
+	for i := len(txns) - 1; i >= 0; i-- { // Get returns newest first
+		s.insert(fromModel(txns[i].toModel()))
+	}
+	s.warmed, s.warmedFrom, s.lastSweep = true, from, time.Now()
+	log.Printf("Window store: Warmed with %d transactions of %d users since %s", len(txns), len(s.users), from.Format(time.RFC3339))
+	return nil
+}
+
+// Observe adds txn to the store. Adding a transaction twice, e.g. on a retry, keeps one copy.
+func (s *WindowStore) Observe(txn model.Transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.warmed {
+		return
+	}
+	s.insert(fromModel(txn))
+	if profile := s.profiles[txn.UserID]; profile != nil {
+		profile.observe(profileEntry{id: txn.ID, txnType: txn.Type, amount: txn.Amount, timestamp: txn.Timestamp})
+	}
+	if time.Since(s.lastSweep) >= s.retention {
+		s.sweep()
+	}
+}
+
+func (s *WindowStore) Get(ctx context.Context, filters Filter) ([]Transaction, error) {
+	matches := make([]Transaction, 0)
+	ok := s.inWindow(filters, func(txns []Transaction, _, _ float64) {
+		for i := len(txns) - 1; i >= 0; i-- { // Newest first, like the SQL query
+			if matchesFilters(filters, txns[i]) {
+				matches = append(matches, txns[i])
+			}
+		}
+	})
+	if ok {
+		return matches, nil
+	}
+	return s.Repository.Get(ctx, filters)
+}
+
+func (s *WindowStore) Count(ctx context.Context, filters Filter) (int, error) {
+	count := 0
+	ok := s.inWindow(filters, func(txns []Transaction, _, _ float64) {
+		if timeBoundsOnly(filters) {
+			count = len(txns)
+			return
+		}
+		for _, txn := range txns {
+			if matchesFilters(filters, txn) {
+				count++
+			}
+		}
+	})
+	if ok {
+		return count, nil
+	}
+	return s.Repository.Count(ctx, filters)
+}
+
+func (s *WindowStore) Sum(ctx context.Context, filters Filter) (float64, error) {
+	sum := 0.0
+	ok := s.inWindow(filters, func(txns []Transaction, sumBefore, sumAfter float64) {
+		if timeBoundsOnly(filters) {
+			sum = sumAfter - sumBefore
+			return
+		}
+		for _, txn := range txns {
+			if matchesFilters(filters, txn) {
+				sum += txn.Amount
+			}
+		}
+	})
+	if ok {
+		return sum, nil
+	}
+	return s.Repository.Sum(ctx, filters)
+}
+
+func (s *WindowStore) AggregateByBucket(ctx context.Context, filters Filter, size time.Duration) ([]Bucket, error) {
+	seconds := int64(size / time.Second)
+	buckets := make([]Bucket, 0)
+	ok := seconds > 0 && s.inWindow(filters, func(txns []Transaction, _, _ float64) {
+		for _, txn := range txns { // Oldest first, like the SQL query
+			if !matchesFilters(filters, txn) {
+				continue
+			}
+			start := time.Unix(txn.Timestamp.Unix()/seconds*seconds, 0).UTC()
+			if len(buckets) == 0 || !buckets[len(buckets)-1].Start.Equal(start) {
+				buckets = append(buckets, Bucket{Start: start})
+			}
+			buckets[len(buckets)-1].Count++
+			buckets[len(buckets)-1].Sum += txn.Amount
+		}
+	})
+	if ok {
+		return buckets, nil
+	}
+	return s.Repository.AggregateByBucket(ctx, filters, size)
+}
+
+// Profile keeps each user's profile up to date from the transactions the Manager processes, so a
+// transaction only adds what happened since the user's previous one instead of recomputing the whole
+// period with SQL. A user's first profile is loaded from SQL, and so is one for a period the kept
+// profile cannot move forward to: an earlier one, e.g. when retrying an older transaction, or one of
+// another length, in which case the new length is kept from then on.
+func (s *WindowStore) Profile(ctx context.Context, userID string, since, before time.Time) (UserProfile, error) {
+	period := before.Sub(since)
+	s.mu.Lock()
+	if !s.warmed {
+		s.mu.Unlock()
+		return s.Repository.Profile(ctx, userID, since, before)
+	}
+	if kept := s.profiles[userID]; kept != nil && kept.period == period {
+		if before.Before(kept.before) {
+			s.mu.Unlock()
+			return s.Repository.Profile(ctx, userID, since, before)
+		}
+		kept.advance(before)
+		profile := kept.profile()
+		s.mu.Unlock()
+		return profile, nil
+	}
+	s.mu.Unlock()
+
+	txns, err := s.Repository.Get(ctx, Filter{UserID: userID, Since: &since})
+	if err != nil {
+		return UserProfile{}, fmt.Errorf("failed to load profile of user %s: %w", userID, err)
+	}
+	loaded := newRollingProfile(period, since, txns)
+	loaded.advance(before)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles[userID] = loaded
+	return loaded.profile(), nil
+}
+
+// inWindow calls fn, under the read lock, with the user's transactions within the filters' time bounds,
+// oldest first, and the running totals before and after them. It reports false without calling fn
+// when filters cannot be answered from memory. fn must not keep txns, and still has to apply the
+// other filters, see matchesFilters.
+func (s *WindowStore) inWindow(filters Filter, fn func(txns []Transaction, sumBefore, sumAfter float64)) bool {
+	inMemory := filters.UserID != "" && filters.Since != nil && filters.IsSuspicious == nil && filters.AnalysisStatus == "" &&
+		filters.MinRiskScore == nil && filters.RiskBand == ""
+	if !inMemory {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.warmed || filters.Since.Before(s.coveredFrom()) {
+		return false
+	}
+
+	user := s.users[filters.UserID]
+	if user == nil {
+		fn(nil, 0, 0)
+		return true
+	}
+	txns := user.txns
+	first := sort.Search(len(txns), func(i int) bool { return !txns[i].Timestamp.Before(*filters.Since) })
+	end := len(txns)
+	if filters.Until != nil {
+		end = min(end, sort.Search(len(txns), func(i int) bool { return txns[i].Timestamp.After(*filters.Until) }))
+	}
+	if filters.Before != nil {
+		end = min(end, sort.Search(len(txns), func(i int) bool { return !txns[i].Timestamp.Before(*filters.Before) }))
+	}
+	end = max(end, first)
+	fn(txns[first:end], user.sums[first], user.sums[end])
+	return true
+}
+
+// timeBoundsOnly reports whether filters, as answered by inWindow, select every transaction in the
+// time bounds.
+func timeBoundsOnly(filters Filter) bool {
+	return filters.Type == "" && len(filters.Types) == 0 && filters.CounterpartyID == "" &&
+		filters.AmountLessThan == nil && filters.AmountAtLeast == nil
+}
+
+// matchesFilters applies the filters inWindow leaves to its callers.
+func matchesFilters(filters Filter, txn Transaction) bool {
+	switch {
+	case filters.Type != "" && txn.Type != filters.Type,
+		len(filters.Types) > 0 && !slices.Contains(filters.Types, txn.Type),
+		filters.CounterpartyID != "" && txn.CounterpartyID != filters.CounterpartyID,
+		filters.AmountLessThan != nil && txn.Amount >= *filters.AmountLessThan,
+		filters.AmountAtLeast != nil && txn.Amount < *filters.AmountAtLeast:
+		return false
+	}
+	return true
+}
+
+// coveredFrom is the oldest time the store is complete from: what was warmed, minus what was swept.
+func (s *WindowStore) coveredFrom() time.Time {
+	from := time.Now().Add(-s.retention)
+	if from.Before(s.warmedFrom) {
+		return s.warmedFrom
+	}
+	return from
+}
+
+// insert keeps the user's transactions in timestamp order, so late arrivals land in the right place.
+// Only the running totals from a late arrival on need updating; the usual append updates one.
+func (s *WindowStore) insert(txn Transaction) {
+	user := s.users[txn.UserID]
+	if user == nil {
+		user = &userWindow{sums: []float64{0}}
+		s.users[txn.UserID] = user
+	}
+	txns := user.txns
+	i := sort.Search(len(txns), func(i int) bool { return txns[i].Timestamp.After(txn.Timestamp) })
+	for j := i - 1; j >= 0 && txns[j].Timestamp.Equal(txn.Timestamp); j-- {
+		if txns[j].ID == txn.ID {
+			return
+		}
+	}
+	user.txns = slices.Insert(txns, i, txn)
+	user.sums = append(user.sums, 0)
+	for j := i; j < len(user.txns); j++ {
+		user.sums[j+1] = user.sums[j] + user.txns[j].Amount
+	}
+}
+
+// sweep drops the transactions that have fallen out of the retention period, and the profiles whose
+// whole period has passed.
+func (s *WindowStore) sweep() {
+	now := time.Now()
+	for user, profile := range s.profiles {
+		if profile.before.Before(now.Add(-profile.period)) {
+			delete(s.profiles, user)
+		}
+	}
+	cutoff := now.Add(-s.retention)
+	for userID, user := range s.users {
+		keep := sort.Search(len(user.txns), func(i int) bool { return !user.txns[i].Timestamp.Before(cutoff) })
+		if keep == len(user.txns) {
+			delete(s.users, userID)
+			continue
+		}
+		kept := &userWindow{txns: append([]Transaction(nil), user.txns[keep:]...), sums: make([]float64, len(user.txns)-keep+1)}
+		for j, txn := range kept.txns {
+			kept.sums[j+1] = kept.sums[j] + txn.Amount
+		}
+		s.users[userID] = kept
+	}
+	s.lastSweep = time.Now()
+}
@@ -0,0 +1,149 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWindowStore tests that window queries are answered from memory like SQL would, and fall back
+// to SQL when the store is cold or the window is older than the retention period.
+func TestWindowStore(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, tx := range []Transaction{
+		{ID: "ws_old", UserID: "u1", Amount: 5, Type: model.DepositType, Timestamp: now.Add(-3 * time.Hour)},
+		{ID: "ws_1", UserID: "u1", Amount: 5, Type: model.DepositType, Timestamp: now.Add(-30 * time.Minute)},
+		{ID: "ws_2", UserID: "u1", Amount: 500, Type: model.TransferType, Timestamp: now.Add(-20 * time.Minute)},
+		{ID: "ws_3", UserID: "u1", Amount: 50, Type: model.TransferType, Timestamp: now.Add(-10 * time.Minute)},
+		{ID: "ws_other", UserID: "u2", Amount: 5, Type: model.DepositType, Timestamp: now.Add(-10 * time.Minute)},
+	} {
+		insertTestData(t, db, tx)
+	}
+	store := NewWindowStore(repo, time.Hour)
+
+	ids := func(t *testing.T, r Repository, filters Filter) []string {
+		t.Helper()
+		txns, err := r.Get(ctx, filters)
+		require.NoError(t, err)
+		return transactionIDs(txns)
+	}
+	since := now.Add(-45 * time.Minute)
+	until := now.Add(-15 * time.Minute)
+	small := 100.0
+	filters := []Filter{
+		{UserID: "u1", Since: &since},
+		{UserID: "u1", Since: &since, Until: &until},
+		{UserID: "u1", Since: &since, Before: &until},
+		{UserID: "u1", Since: &since, Type: model.TransferType},
+		{UserID: "u1", Since: &since, AmountLessThan: &small},
+	}
+
+	require.NoError(t, store.Warm(ctx))
+	for _, f := range filters {
+		assert.Equal(t, ids(t, repo, f), ids(t, store, f), "Filter %+v", f)
+
+		want, err := repo.AggregateByBucket(ctx, f, 15*time.Minute)
+		require.NoError(t, err)
+		got, err := store.AggregateByBucket(ctx, f, 15*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "Filter %+v", f)
+
+		wantCount, err := repo.Count(ctx, f)
+		require.NoError(t, err)
+		gotCount, err := store.Count(ctx, f)
+		require.NoError(t, err)
+		assert.Equal(t, wantCount, gotCount, "Filter %+v", f)
+
+		wantSum, err := repo.Sum(ctx, f)
+		require.NoError(t, err)
+		gotSum, err := store.Sum(ctx, f)
+		require.NoError(t, err)
+		assert.Equal(t, wantSum, gotSum, "Filter %+v", f)
+	}
+
+	// Observed transactions are answered from memory, without reading the database.
+	late := model.Transaction{ID: "ws_late", UserID: "u1", Amount: 1, Type: model.DepositType, Timestamp: now.Add(-25 * time.Minute)}
+	store.Observe(late)
+	store.Observe(late)
+	assert.Equal(t, []string{"ws_3", "ws_2", "ws_late", "ws_1"}, ids(t, store, Filter{UserID: "u1", Since: &since}))
+	count, err := store.Count(ctx, Filter{UserID: "u1", Since: &since})
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+	sum, err := store.Sum(ctx, Filter{UserID: "u1", Since: &since})
+	require.NoError(t, err)
+	assert.Equal(t, 556.0, sum)
+
+	t.Run("falls back to SQL", func(t *testing.T) {
+		longAgo := now.Add(-4 * time.Hour)
+		assert.Equal(t, []string{"ws_3", "ws_2", "ws_1", "ws_old"}, ids(t, store, Filter{UserID: "u1", Since: &longAgo}), "Older than the retention")
+		assert.Equal(t, []string{"ws_3", "ws_2", "ws_1"}, ids(t, NewWindowStore(repo, time.Hour), Filter{UserID: "u1", Since: &since}), "Not warmed")
+	})
+
+	t.Run("kept in sync by Manager", func(t *testing.T) {
+		next := model.Transaction{ID: "ws_next", UserID: "u2", Amount: 5, Type: model.DepositType, Timestamp: now}
+		insertTestData(t, db, Transaction{ID: next.ID, UserID: next.UserID, Amount: next.Amount, Type: next.Type, Timestamp: next.Timestamp})
+		manager := NewManager(store, NewFrequentSmallTransactionsRule(store, 1, 100, time.Hour, 50))
+		require.NoError(t, manager.Process(ctx, next))
+
+		analyzed, err := repo.Get(ctx, Filter{UserID: "u2", Since: &since})
+		require.NoError(t, err)
+		require.Len(t, analyzed, 2)
+		assert.True(t, analyzed[0].IsSuspicious, "Both of u2's small transactions should be counted")
+	})
+}
+
+// TestWindowStore_Profile tests that the profiles kept up to date in memory match the ones computed
+// with SQL as the evaluated transactions move forward, and that older periods fall back to SQL.
+func TestWindowStore_Profile(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	types := []string{model.DepositType, model.WithdrawalType, model.TransferType}
+	for i := 0; i < 60; i++ {
+		insertTestData(t, db, Transaction{ID: fmt.Sprintf("wp_old_%d", i), UserID: "u1", Amount: float64(10 + i*7%50), Type: types[i%3],
+			Timestamp: now.Add(-40*24*time.Hour + time.Duration(i*15)*time.Hour)})
+	}
+	store := NewWindowStore(repo, time.Hour)
+	require.NoError(t, store.Warm(ctx))
+
+	const lookback = 30 * 24 * time.Hour
+	assertSameProfile := func(t *testing.T, at time.Time) {
+		t.Helper()
+		want, err := repo.Profile(ctx, "u1", at.Add(-lookback), at)
+		require.NoError(t, err)
+		got, err := store.Profile(ctx, "u1", at.Add(-lookback), at)
+		require.NoError(t, err)
+		assert.Equal(t, want.Transactions, got.Transactions)
+		assert.InDelta(t, want.DailyMean, got.DailyMean, 1e-9)
+		assert.InDelta(t, want.DailyStdDev, got.DailyStdDev, 1e-9)
+		assert.InDeltaSlice(t, want.HourShare[:], got.HourShare[:], 1e-9)
+		require.Len(t, got.Types, len(want.Types))
+		for txnType, amounts := range want.Types {
+			assert.Equal(t, amounts.Count, got.Types[txnType].Count, txnType)
+			assert.InDelta(t, amounts.Mean, got.Types[txnType].Mean, 1e-9, txnType)
+			assert.InDelta(t, amounts.StdDev, got.Types[txnType].StdDev, 1e-6, txnType)
+		}
+	}
+
+	// Evaluate new transactions in order, each one moving the profile forward by a few days.
+	for i := 0; i < 5; i++ {
+		txn := model.Transaction{ID: fmt.Sprintf("wp_new_%d", i), UserID: "u1", Amount: 100, Type: model.TransferType,
+			Timestamp: now.Add(-5*24*time.Hour + time.Duration(i*29)*time.Hour)}
+		insertTestData(t, db, fromModel(txn))
+		store.Observe(txn)
+		assertSameProfile(t, txn.Timestamp)
+	}
+	assertSameProfile(t, now.Add(-20*24*time.Hour)) // Older than the kept profile, from SQL
+	assertSameProfile(t, now)
+}
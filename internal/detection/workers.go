@@ -0,0 +1,130 @@
+package detection
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+var (
+	ErrManagerNotStarted = errors.New("detection manager workers are not started")
+	ErrManagerStopped    = errors.New("detection manager is stopped")
+)
+
+type job struct {
+	txn  model.Transaction
+	done func(error)
+}
+
+// Run launches the worker pool. Transactions are sharded by UserID, so each user's transactions
+// are processed one at a time and in submission order, which the windowed rules rely on, while
+// different users are processed in parallel. Cancelling ctx aborts in-flight processing; use Stop
+// for a graceful shutdown.
+func (m *Manager) Run(ctx context.Context, workers, queueDepth int) {
+	if workers <= 0 {
+		workers = 1
+	}
+	m.processCtx, m.cancelProcessing = context.WithCancel(ctx)
+	m.stopCh = make(chan struct{})
+	m.queues = make([]chan job, workers)
+	for i := range m.queues {
+		queue := make(chan job, queueDepth)
+		m.queues[i] = queue
+		m.workers.Add(1)
+		go m.work(queue)
+	}
+	log.Printf("Detection Manager: Started %d workers with queue depth %d", workers, queueDepth)
+}
+
+// Submit queues txn on the worker owning its user and returns once it is queued. done is called from
+// the worker with the result of Process, or with ErrManagerStopped if the item was abandoned by Stop.
+// Submit blocks while that worker's queue is full, until ctx is done or the Manager is stopped.
+func (m *Manager) Submit(ctx context.Context, txn model.Transaction, done func(error)) error {
+	m.submitMu.RLock()
+	defer m.submitMu.RUnlock()
+	if len(m.queues) == 0 {
+		return ErrManagerNotStarted
+	}
+	if m.stopped {
+		return ErrManagerStopped
+	}
+	select {
+	case m.queues[m.shardFor(txn.UserID)] <- job{txn: txn, done: done}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.stopCh:
+		return ErrManagerStopped
+	}
+}
+
+// Stop stops accepting work and lets the workers drain their queues until ctx is done. Anything
+// still queued at that point is handed back to its submitter with ErrManagerStopped, so it can be
+// persisted for the next run, and in-flight processing is cancelled. It returns the number of
+// items left unprocessed, along with ctx's error if the deadline was hit. Calling Stop again returns
+// ErrManagerStopped.
+func (m *Manager) Stop(ctx context.Context) (int, error) {
+	if len(m.queues) == 0 {
+		return 0, ErrManagerNotStarted
+	}
+	if !m.stopping.CompareAndSwap(false, true) {
+		return 0, ErrManagerStopped
+	}
+
+	// Wake up blocked submitters, then wait for all of them to leave before closing the queues.
+	close(m.stopCh)
+	m.submitMu.Lock()
+	m.stopped = true
+	for _, queue := range m.queues {
+		close(queue)
+	}
+	m.submitMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		m.cancelProcessing()
+		log.Println("Detection Manager: Stopped, all queued transactions processed.")
+		return 0, nil
+	case <-ctx.Done():
+	}
+
+	m.abandon.Store(true)
+	m.cancelProcessing()
+	<-drained
+	unprocessed := int(m.abandoned.Load())
+	log.Printf("Detection Manager: Stopped before draining, %d transactions left unprocessed.", unprocessed)
+	return unprocessed, ctx.Err()
+}
+
+func (m *Manager) shardFor(userID string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return int(h.Sum32() % uint32(len(m.queues)))
+}
+
+func (m *Manager) work(queue <-chan job) {
+	defer m.workers.Done()
+	for j := range queue {
+		if m.abandon.Load() {
+			m.abandoned.Add(1)
+			j.done(ErrManagerStopped)
+			continue
+		}
+		err := m.Process(m.processCtx, j.txn)
+		if err != nil && m.processCtx.Err() != nil {
+			// Cancelled by Stop or the Run context rather than a detection failure.
+			m.abandoned.Add(1)
+			err = ErrManagerStopped
+		}
+		j.done(err)
+	}
+}
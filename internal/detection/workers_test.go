@@ -0,0 +1,166 @@
+package detection
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingRule records the order transactions are evaluated in and blocks on the given user until released.
+type recordingRule struct {
+	mu        sync.Mutex
+	seen      map[string][]string
+	blockUser string
+	release   chan struct{}
+}
+
+func (r *recordingRule) Name() string { return "Recording" }
+
+func (r *recordingRule) DetectSuspiciousActivity(txn model.Transaction) (Result, error) {
+	if txn.UserID == r.blockUser {
+		<-r.release
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen[txn.UserID] = append(r.seen[txn.UserID], txn.ID)
+	return Result{}, nil
+}
+
+// TestManager_Submit_OrdersPerUserAndRunsUsersInParallel tests that a slow user does not stall others
+// and that each user's transactions are processed in submission order.
+func TestManager_Submit_OrdersPerUserAndRunsUsersInParallel(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	rule := &recordingRule{seen: map[string][]string{}, blockUser: "slow_user", release: make(chan struct{})}
+	manager := NewManager(repo, rule)
+	manager.Run(ctx, 4, 10)
+
+	// Users sharing the slow user's worker are expected to wait, so only pick users on other workers.
+	users := []string{"slow_user"}
+	for i := 0; len(users) < 4; i++ {
+		if user := fmt.Sprintf("fast_user_%d", i); manager.shardFor(user) != manager.shardFor("slow_user") {
+			users = append(users, user)
+		}
+	}
+
+	var (
+		wg        sync.WaitGroup
+		fastWG    sync.WaitGroup
+		submitted = map[string][]string{}
+	)
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		for _, user := range users {
+			txn := model.Transaction{ID: fmt.Sprintf("%s_%d", user, i), UserID: user, Amount: 1, Type: model.DepositType, Timestamp: now}
+			insertTestData(t, db, Transaction{ID: txn.ID, UserID: txn.UserID, Amount: txn.Amount, Type: txn.Type, Timestamp: txn.Timestamp})
+			submitted[user] = append(submitted[user], txn.ID)
+
+			wg.Add(1)
+			isFast := user != "slow_user"
+			if isFast {
+				fastWG.Add(1)
+			}
+			err := manager.Submit(ctx, txn, func(err error) {
+				assert.NoError(t, err)
+				if isFast {
+					fastWG.Done()
+				}
+				wg.Done()
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	fastDone := make(chan struct{})
+	go func() {
+		fastWG.Wait()
+		close(fastDone)
+	}()
+	select {
+	case <-fastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Other users were stalled by a slow user")
+	}
+
+	close(rule.release)
+	wg.Wait()
+
+	for user, ids := range submitted {
+		assert.Equal(t, ids, rule.seen[user], "Transactions of %s processed out of order", user)
+	}
+}
+
+// TestManager_Stop tests that Stop drains queued work, reports and hands back what it could not drain in
+// time, and can be called more than once.
+func TestManager_Stop(t *testing.T) {
+	db, repo, cleanup := setupDetectionTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	submit := func(t *testing.T, manager *Manager, id string, results chan<- error) {
+		t.Helper()
+		insertTestData(t, db, Transaction{ID: id, UserID: "stop_user", Amount: 1, Type: model.DepositType, Timestamp: now})
+		txn := model.Transaction{ID: id, UserID: "stop_user", Amount: 1, Type: model.DepositType, Timestamp: now}
+		require.NoError(t, manager.Submit(ctx, txn, func(err error) { results <- err }))
+	}
+
+	t.Run("drains within deadline", func(t *testing.T) {
+		rule := &recordingRule{seen: map[string][]string{}}
+		manager := NewManager(repo, rule)
+		manager.Run(ctx, 2, 10)
+
+		results := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			submit(t, manager, fmt.Sprintf("stop_drain_%d", i), results)
+		}
+
+		stopCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		unprocessed, err := manager.Stop(stopCtx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, unprocessed)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, <-results)
+		}
+
+		err = manager.Submit(ctx, model.Transaction{ID: "late", UserID: "stop_user"}, func(error) {})
+		require.ErrorIs(t, err, ErrManagerStopped)
+
+		_, err = manager.Stop(stopCtx)
+		require.ErrorIs(t, err, ErrManagerStopped, "A second Stop must not panic")
+	})
+
+	t.Run("abandons remaining work after deadline", func(t *testing.T) {
+		rule := &recordingRule{seen: map[string][]string{}, blockUser: "stop_user", release: make(chan struct{})}
+		manager := NewManager(repo, rule)
+		manager.Run(ctx, 1, 10)
+
+		results := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			submit(t, manager, fmt.Sprintf("stop_abandon_%d", i), results)
+		}
+
+		stopCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		go func() {
+			<-stopCtx.Done()
+			close(rule.release) // Let the in-flight rule return once the deadline has passed
+		}()
+		unprocessed, err := manager.Stop(stopCtx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 3, unprocessed, "The in-flight transaction is cancelled and the two queued ones are abandoned")
+
+		for i := 0; i < 3; i++ {
+			assert.ErrorIs(t, <-results, ErrManagerStopped)
+		}
+	})
+}
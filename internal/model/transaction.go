@@ -10,6 +10,14 @@ type Transaction struct {
 	Amount    float64   `json:"amount" db:"amount"`
 	Type      string    `json:"type" db:"type"`
 	Timestamp time.Time `json:"timestamp" db:"timestamp"`
+	// Where the money moves between. Transfers require a counterparty: the user or business on the
+	// other side, e.g. the recipient of a transfer.
+	SourceAccount      string         `json:"sourceAccount,omitempty" db:"source_account"`
+	DestinationAccount string         `json:"destinationAccount,omitempty" db:"destination_account"`
+	CounterpartyID     string         `json:"counterpartyId,omitempty" db:"counterparty_id"`
+	CounterpartyName   string         `json:"counterpartyName,omitempty" db:"counterparty_name"`
+	Channel            string         `json:"channel,omitempty" db:"channel"`
+	Metadata           map[string]any `json:"metadata,omitempty" db:"metadata"` // Free-form, stored as JSON
 }
 
 const (
@@ -17,3 +25,11 @@ const (
 	WithdrawalType = "withdrawal"
 	TransferType   = "transfer"
 )
+
+// Channels a transaction can be made through.
+const (
+	WebChannel    = "web"
+	MobileChannel = "mobile"
+	ATMChannel    = "atm"
+	APIChannel    = "api"
+)
@@ -0,0 +1,124 @@
+package transaction
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+// FileLogPublisher appends transactions as JSON lines to a local file, which is drained in batches.
+// It survives restarts, but not the loss of the disk it is on.
+type FileLogPublisher struct {
+	path string
+	mu   sync.Mutex // Serializes appends, and the rotation in Drain
+}
+
+func NewFileLogPublisher(path string) *FileLogPublisher {
+	return &FileLogPublisher{path: path}
+}
+
+func (f *FileLogPublisher) Publish(_ context.Context, tx model.Transaction) error {
+	line, err := json.Marshal(tx)
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction (id: %s) for file log: %w", tx.ID, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open file log %s: %w", f.path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to append transaction (id: %s) to file log: %w", tx.ID, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file log %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// Drain moves the current log aside and passes everything in it to handle. The moved-aside file is
+// only deleted once handle succeeds, so a failed or interrupted drain is retried on the next call.
+// It returns the number of transactions handled.
+func (f *FileLogPublisher) Drain(ctx context.Context, handle func(ctx context.Context, txns []model.Transaction) error) (int, error) {
+	draining := f.path + ".draining"
+	if _, err := os.Stat(draining); errors.Is(err, os.ErrNotExist) {
+		f.mu.Lock()
+		err = os.Rename(f.path, draining)
+		f.mu.Unlock()
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to rotate file log %s: %w", f.path, err)
+		}
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to check file log %s: %w", draining, err)
+	}
+
+	txns, err := readFileLog(draining)
+	if err != nil {
+		return 0, err
+	}
+	if err := handle(ctx, txns); err != nil {
+		return 0, fmt.Errorf("failed to handle %d transactions from file log: %w", len(txns), err)
+	}
+	if err := os.Remove(draining); err != nil {
+		return len(txns), fmt.Errorf("failed to remove drained file log %s: %w", draining, err)
+	}
+	return len(txns), nil
+}
+
+// DrainEvery calls Drain every interval until ctx is cancelled.
+func (f *FileLogPublisher) DrainEvery(ctx context.Context, interval time.Duration, handle func(ctx context.Context, txns []model.Transaction) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if count, err := f.Drain(ctx, handle); err != nil {
+			log.Printf("File Log: Error draining %s: %v", f.path, err)
+		} else if count > 0 {
+			log.Printf("File Log: Drained %d transactions from %s", count, f.path)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func readFileLog(path string) ([]model.Transaction, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file log %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var txns []model.Transaction
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var tx model.Transaction
+		if err := json.Unmarshal(scanner.Bytes(), &tx); err != nil {
+			// Most likely a line torn by a crash mid-append; that request was never acknowledged.
+			log.Printf("File Log: Skipping unreadable line in %s: %v", path, err)
+			continue
+		}
+		txns = append(txns, tx)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file log %s: %w", path, err)
+	}
+	return txns, nil
+}
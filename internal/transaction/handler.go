@@ -35,6 +35,11 @@ func (h *Handler) CreateTransaction(c echo.Context) error {
 
 			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
+		if errors.Is(err, ErrQueueFull) {
+			log.Printf("Handler: Detection queue full: %v", err)
+
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many transactions pending analysis, please retry later")
+		}
 		if errors.Is(err, ErrConflict) {
 			log.Printf("Handler: Conflict error from service: %v", err)
 
@@ -0,0 +1,144 @@
+package transaction
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+)
+
+var ErrQueueFull = errors.New("detection queue is full")
+
+// Publisher hands newly created transactions over to detection. The Service calls Publish after the
+// transaction is committed, so detection never sees a transaction that was not stored. A failed
+// publish cannot undo the insert, so the Service writes the transaction to the outbox instead.
+type Publisher interface {
+	Publish(ctx context.Context, tx model.Transaction) error
+}
+
+// TxPublisher is implemented by publishers that write within the SQL transaction that saves tx. The
+// Service runs PublishTx as a SaveHook instead of calling Publish, so the publish commits or rolls
+// back together with the insert.
+type TxPublisher interface {
+	Publisher
+	PublishTx(ctx context.Context, sqlTx *sql.Tx, tx model.Transaction) error
+}
+
+// Waiter is implemented by publishers that can run out of capacity. The Service calls Wait before
+// opening the SQL transaction, so a full publisher rejects the request before anything is stored, and
+// waiting never holds the database write lock that detection needs in order to make room.
+type Waiter interface {
+	Wait(ctx context.Context) error
+}
+
+// OutboxPublisher writes to the transaction_outbox table, which detection.Relay polls. It is the
+// only publisher that commits atomically with the insert.
+type OutboxPublisher struct{}
+
+func NewOutboxPublisher() OutboxPublisher {
+	return OutboxPublisher{}
+}
+
+// Publish does nothing: the outbox entry was committed with the transaction by PublishTx.
+func (OutboxPublisher) Publish(context.Context, model.Transaction) error {
+	return nil
+}
+
+const insertOutboxEntry = `INSERT INTO transaction_outbox (transaction_id, created_at) VALUES (?, ?)`
+
+func (OutboxPublisher) PublishTx(ctx context.Context, sqlTx *sql.Tx, tx model.Transaction) error {
+	if _, err := sqlTx.ExecContext(ctx, insertOutboxEntry, tx.ID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to insert outbox entry (id: %s): %w", tx.ID, err)
+	}
+	return nil
+}
+
+// OverflowPolicy decides what QueuePublisher does when its queue is full.
+type OverflowPolicy string
+
+const (
+	OverflowBlock  OverflowPolicy = "block"  // Wait up to the block timeout for room, then reject
+	OverflowSpill  OverflowPolicy = "spill"  // Hand the transaction to the spill publisher, e.g. a FileLogPublisher
+	OverflowReject OverflowPolicy = "reject" // Reject straight away with ErrQueueFull
+)
+
+const queueWaitPollInterval = 10 * time.Millisecond
+
+// QueuePublisher is a bounded in-memory queue, consumed through Out. Queued transactions are lost on
+// a crash, until boot recovery re-enqueues them from their PENDING status.
+type QueuePublisher struct {
+	queue        chan model.Transaction
+	overflow     OverflowPolicy
+	blockTimeout time.Duration
+	spill        Publisher
+}
+
+func NewQueuePublisher(size int, overflow OverflowPolicy, blockTimeout time.Duration, spill Publisher) (*QueuePublisher, error) {
+	switch overflow {
+	case OverflowBlock, OverflowReject:
+	case OverflowSpill:
+		if spill == nil {
+			return nil, fmt.Errorf("overflow policy %q requires a spill publisher", overflow)
+		}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q, must be one of [%s, %s, %s]", overflow, OverflowBlock, OverflowSpill, OverflowReject)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("queue size must be positive, got %d", size)
+	}
+	return &QueuePublisher{
+		queue:        make(chan model.Transaction, size),
+		overflow:     overflow,
+		blockTimeout: blockTimeout,
+		spill:        spill,
+	}, nil
+}
+
+// Out is the consuming end of the queue.
+func (q *QueuePublisher) Out() <-chan model.Transaction {
+	return q.queue
+}
+
+// Wait blocks until the queue has room or the block timeout passes. It only waits for OverflowBlock;
+// OverflowReject fails straight away when the queue is full, and OverflowSpill never fails.
+func (q *QueuePublisher) Wait(ctx context.Context) error {
+	if len(q.queue) < cap(q.queue) || q.overflow == OverflowSpill {
+		return nil
+	}
+	if q.overflow == OverflowReject {
+		return fmt.Errorf("%w: %d transactions queued", ErrQueueFull, cap(q.queue))
+	}
+
+	timeout := time.NewTimer(q.blockTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(queueWaitPollInterval)
+	defer ticker.Stop()
+	for len(q.queue) >= cap(q.queue) {
+		select {
+		case <-timeout.C:
+			return fmt.Errorf("%w: no room after waiting %s", ErrQueueFull, q.blockTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Publish never blocks; waiting for room is done up front by Wait. The queue can still fill up between
+// Wait and Publish, in which case the Service falls back to the outbox.
+func (q *QueuePublisher) Publish(ctx context.Context, tx model.Transaction) error {
+	select {
+	case q.queue <- tx:
+		return nil
+	default:
+	}
+
+	if q.overflow == OverflowSpill {
+		return q.spill.Publish(ctx, tx)
+	}
+	return fmt.Errorf("%w: %d transactions queued", ErrQueueFull, cap(q.queue))
+}
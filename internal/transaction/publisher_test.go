@@ -0,0 +1,104 @@
+package transaction
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestQueuePublisher_Overflow tests each overflow policy once the queue is full.
+func TestQueuePublisher_Overflow(t *testing.T) {
+	ctx := context.Background()
+	tx := model.Transaction{ID: "queued", UserID: "user_id_1", Amount: 1, Type: model.DepositType}
+
+	t.Run("reject", func(t *testing.T) {
+		queue, err := NewQueuePublisher(1, OverflowReject, 0, nil)
+		require.NoError(t, err)
+		require.NoError(t, queue.Publish(ctx, tx))
+		require.ErrorIs(t, queue.Wait(ctx), ErrQueueFull, "Reject should fail before saving, without waiting")
+		require.ErrorIs(t, queue.Publish(ctx, tx), ErrQueueFull)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		queue, err := NewQueuePublisher(1, OverflowBlock, 50*time.Millisecond, nil)
+		require.NoError(t, err)
+		require.NoError(t, queue.Publish(ctx, tx))
+		require.ErrorIs(t, queue.Wait(ctx), ErrQueueFull, "Wait should give up after the block timeout")
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			<-queue.Out()
+		}()
+		queue.blockTimeout = time.Second
+		require.NoError(t, queue.Wait(ctx), "Wait should return once the consumer makes room")
+		require.NoError(t, queue.Publish(ctx, tx))
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		spill := NewFileLogPublisher(filepath.Join(t.TempDir(), "spill.log"))
+		queue, err := NewQueuePublisher(1, OverflowSpill, 0, spill)
+		require.NoError(t, err)
+		require.NoError(t, queue.Publish(ctx, tx))
+		spilled := tx
+		spilled.ID = "spilled"
+		require.NoError(t, queue.Publish(ctx, spilled))
+
+		var drained []model.Transaction
+		count, err := spill.Drain(ctx, func(_ context.Context, txns []model.Transaction) error {
+			drained = txns
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		require.Len(t, drained, 1)
+		assert.Equal(t, "spilled", drained[0].ID)
+	})
+
+	t.Run("spill without spill publisher", func(t *testing.T) {
+		_, err := NewQueuePublisher(1, OverflowSpill, 0, nil)
+		require.Error(t, err)
+	})
+}
+
+// TestFileLogPublisher_Drain tests that a failed drain is retried and that appends during a drain are kept.
+func TestFileLogPublisher_Drain(t *testing.T) {
+	ctx := context.Background()
+	fileLog := NewFileLogPublisher(filepath.Join(t.TempDir(), "transactions.log"))
+
+	count, err := fileLog.Drain(ctx, func(context.Context, []model.Transaction) error { return nil })
+	require.NoError(t, err, "Draining a log that was never written should be a no-op")
+	assert.Equal(t, 0, count)
+
+	for _, id := range []string{"file_1", "file_2"} {
+		require.NoError(t, fileLog.Publish(ctx, model.Transaction{ID: id, UserID: "user_id_1", Type: model.DepositType}))
+	}
+
+	_, err = fileLog.Drain(ctx, func(context.Context, []model.Transaction) error {
+		// Published while the first batch is being handled, so it must land in the next batch.
+		require.NoError(t, fileLog.Publish(ctx, model.Transaction{ID: "file_3", UserID: "user_id_1", Type: model.DepositType}))
+		return errors.New("detection unavailable")
+	})
+	require.Error(t, err)
+
+	var batches [][]string
+	handle := func(_ context.Context, txns []model.Transaction) error {
+		ids := make([]string, len(txns))
+		for i, tx := range txns {
+			ids[i] = tx.ID
+		}
+		batches = append(batches, ids)
+		return nil
+	}
+	_, err = fileLog.Drain(ctx, handle)
+	require.NoError(t, err)
+	_, err = fileLog.Drain(ctx, handle)
+	require.NoError(t, err)
+
+	assert.Equal(t, [][]string{{"file_1", "file_2"}, {"file_3"}}, batches)
+}
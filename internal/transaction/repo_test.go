@@ -69,6 +69,30 @@ func TestSQLiteRepository_Migrate(t *testing.T) {
 	require.NoError(t, err, "Failed to insert into table after second migration")
 }
 
+// TestSQLiteRepository_Migrate_AddsColumnsToExistingTable tests that Migrate upgrades a table created before the analysis status columns.
+func TestSQLiteRepository_Migrate_AddsColumnsToExistingTable(t *testing.T) {
+	db, repo, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE transactions (
+        id TEXT PRIMARY KEY, user_id TEXT NOT NULL, amount REAL NOT NULL, type TEXT NOT NULL,
+        timestamp TIMESTAMP NOT NULL, is_suspicious INTEGER NOT NULL DEFAULT 0, flagged_rules TEXT)`)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `INSERT INTO transactions (id, user_id, amount, type, timestamp) VALUES (?, ?, ?, ?, ?)`,
+		"legacy_id", "user_id_1", 1.0, model.DepositType, time.Now())
+	require.NoError(t, err)
+
+	err = repo.Migrate(ctx)
+	require.NoError(t, err, "Migration of existing table failed")
+
+	var status string
+	err = db.QueryRowContext(ctx, "SELECT analysis_status FROM transactions WHERE id = ?", "legacy_id").Scan(&status)
+	require.NoError(t, err)
+	assert.Equal(t, "PENDING", status, "Existing rows should default to PENDING so they are recovered on boot")
+}
+
 // TestSaveSuccess tests saving a valid transaction.
 func TestSQLiteRepository_Save_Success(t *testing.T) {
 	db, repo, cleanup := setupTestDB(t)
@@ -90,7 +114,7 @@ func TestSQLiteRepository_Save_Success(t *testing.T) {
 	}
 
 	// --- Call Save ---
-	err = repo.Save(ctx, saveTx)
+	err = repo.Save(ctx, saveTx, NewOutboxPublisher().PublishTx)
 	require.NoError(t, err, "repo.Save failed")
 
 	// --- Verify Insertion (using raw db connection) ---
@@ -114,11 +138,48 @@ func TestSQLiteRepository_Save_Success(t *testing.T) {
 
 	// Use WithinDuration for time comparison due to potential db precision differences
 	assert.WithinDuration(t, saveTx.Timestamp, retrievedTS, time.Second)
+
+	// --- Verify Outbox Entry ---
+	var outboxCount int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM transaction_outbox WHERE transaction_id = ? AND processed_at IS NULL", saveTx.ID).Scan(&outboxCount)
+	require.NoError(t, err, "Failed to query outbox")
+	assert.Equal(t, 1, outboxCount, "Expected exactly one pending outbox entry for the saved transaction")
+}
+
+// TestSQLiteRepository_Save_Details tests that the optional transfer details are stored, and left NULL when not set.
+func TestSQLiteRepository_Save_Details(t *testing.T) {
+	db, repo, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	require.NoError(t, repo.Migrate(ctx))
+
+	transfer := model.Transaction{
+		ID: "details_transfer", UserID: "user_id_1", Amount: 50, Type: model.TransferType, Timestamp: time.Now().UTC(),
+		SourceAccount: "acc_1", DestinationAccount: "acc_2", CounterpartyID: "user_id_2", CounterpartyName: "Jane Doe",
+		Channel: model.WebChannel, Metadata: map[string]any{"ip": "10.0.0.1"},
+	}
+	plain := model.Transaction{ID: "details_plain", UserID: "user_id_1", Amount: 50, Type: model.DepositType, Timestamp: time.Now().UTC()}
+	require.NoError(t, repo.Save(ctx, transfer))
+	require.NoError(t, repo.Save(ctx, plain))
+
+	query := "SELECT source_account, destination_account, counterparty_id, counterparty_name, channel, metadata FROM transactions WHERE id = ?"
+	var source, destination, counterpartyID, counterpartyName, channel, metadata sql.NullString
+	err := db.QueryRowContext(ctx, query, transfer.ID).Scan(&source, &destination, &counterpartyID, &counterpartyName, &channel, &metadata)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acc_1", "acc_2", "user_id_2", "Jane Doe", model.WebChannel}, []string{source.String, destination.String, counterpartyID.String, counterpartyName.String, channel.String})
+	assert.JSONEq(t, `{"ip":"10.0.0.1"}`, metadata.String)
+
+	err = db.QueryRowContext(ctx, query, plain.ID).Scan(&source, &destination, &counterpartyID, &counterpartyName, &channel, &metadata)
+	require.NoError(t, err)
+	for _, column := range []sql.NullString{source, destination, counterpartyID, counterpartyName, channel, metadata} {
+		assert.False(t, column.Valid, "Unset details should be NULL")
+	}
 }
 
 // TestSaveDuplicateID tests saving a transaction with an existing ID.
 func TestSQLiteRepository_Save_DuplicateID(t *testing.T) {
-	_, repo, cleanup := setupTestDB(t)
+	db, repo, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	ctx := context.Background()
@@ -145,10 +206,16 @@ func TestSQLiteRepository_Save_DuplicateID(t *testing.T) {
 	}
 
 	// --- Save First Tx ---
-	err = repo.Save(ctx, tx1)
+	err = repo.Save(ctx, tx1, NewOutboxPublisher().PublishTx)
 	require.NoError(t, err, "Saving the first transaction failed")
 
 	// --- Save Second Tx (Should Fail) ---
-	err = repo.Save(ctx, tx2)
+	err = repo.Save(ctx, tx2, NewOutboxPublisher().PublishTx)
 	require.Error(t, err, "Expected an error when saving with a duplicate ID")
+
+	// --- Failed Save Must Not Leave An Outbox Entry Behind ---
+	var outboxCount int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM transaction_outbox WHERE transaction_id = ?", commonID).Scan(&outboxCount)
+	require.NoError(t, err, "Failed to query outbox")
+	assert.Equal(t, 1, outboxCount, "Expected the rolled back save to leave only the first outbox entry")
 }
@@ -3,8 +3,11 @@ package transaction
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/jasimvs/sample-go-svc/internal/model"
 )
@@ -13,9 +16,15 @@ var ErrTransactionNotFound = errors.New("transaction not found")
 
 type Repository interface {
 	Migrate(ctx context.Context) error
-	Save(ctx context.Context, tx model.Transaction) error
+	Save(ctx context.Context, tx model.Transaction, hooks ...SaveHook) error
+	// Enqueue adds an outbox entry for a transaction that has already been saved.
+	Enqueue(ctx context.Context, transactionID string) error
 }
 
+// SaveHook runs inside the SQL transaction that inserts tx, right before commit. Returning an error
+// rolls the insert back.
+type SaveHook func(ctx context.Context, sqlTx *sql.Tx, tx model.Transaction) error
+
 type sqliteRepository struct {
 	db *sql.DB
 }
@@ -39,16 +48,59 @@ func (r *sqliteRepository) Migrate(ctx context.Context) error {
 		flagged_rules TEXT
     );`
 
+	// The outbox is written in the same SQL transaction as the insert, so every saved
+	// transaction is guaranteed to reach detection even if the process dies right after commit.
+	outboxQuery := `
+    CREATE TABLE IF NOT EXISTS transaction_outbox (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+		transaction_id TEXT NOT NULL REFERENCES transactions(id),
+        created_at TIMESTAMP NOT NULL,
+		claimed_until TIMESTAMP,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		processed_at TIMESTAMP
+    );`
+
+	// Columns added after the transactions table was first released. They are ALTERed onto
+	// existing databases, so they must be nullable or have a default.
+	addedColumns := []struct{ name, definition string }{
+		{"analysis_status", "TEXT NOT NULL DEFAULT 'PENDING'"},
+		{"status_updated_at", "TIMESTAMP"},
+		{"analyzed_at", "TIMESTAMP"},
+		{"risk_score", "REAL NOT NULL DEFAULT 0"},
+		{"risk_band", "TEXT"},
+		{"risk_factors", "TEXT"}, // JSON array of the matched rules' scores and reasons
+		{"rules_version", "TEXT"},
+		{"source_account", "TEXT"},
+		{"destination_account", "TEXT"},
+		{"counterparty_id", "TEXT"},
+		{"counterparty_name", "TEXT"},
+		{"channel", "TEXT"},
+		{"metadata", "TEXT"}, // JSON object
+	}
+
 	indexQueries := []string{
 		`CREATE INDEX IF NOT EXISTS idx_transactions_user_type_timestamp ON transactions(user_id, type, timestamp);`,
 		`CREATE INDEX IF NOT EXISTS idx_transactions_timestamp ON transactions(timestamp);`,
 		`CREATE INDEX IF NOT EXISTS idx_transactions_user_suspicious ON transactions(user_id, is_suspicious);`,
 		`CREATE INDEX IF NOT EXISTS idx_transactions_amount ON transactions(amount);`,
+		`CREATE INDEX IF NOT EXISTS idx_transaction_outbox_pending ON transaction_outbox(processed_at, id);`,
+		`CREATE INDEX IF NOT EXISTS idx_transactions_analysis_status ON transactions(analysis_status, status_updated_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_transactions_user_risk_score ON transactions(user_id, risk_score);`,
+		`CREATE INDEX IF NOT EXISTS idx_transactions_counterparty_type_timestamp ON transactions(counterparty_id, type, timestamp);`,
 	}
 	_, err := r.db.ExecContext(ctx, query)
 	if err != nil {
 		return fmt.Errorf("failed to create transactions table: %w", err)
 	}
+	for _, column := range addedColumns {
+		if err := r.addColumnIfMissing(ctx, "transactions", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	_, err = r.db.ExecContext(ctx, outboxQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create transaction_outbox table: %w", err)
+	}
 	for _, indexQuery := range indexQueries {
 		_, err := r.db.ExecContext(ctx, indexQuery)
 		if err != nil {
@@ -60,17 +112,103 @@ func (r *sqliteRepository) Migrate(ctx context.Context) error {
 	return nil
 }
 
-func (r *sqliteRepository) Save(ctx context.Context, tx model.Transaction) error {
-	query := `INSERT INTO transactions (id, user_id, amount, type, timestamp) VALUES (?, ?, ?, ?, ?)`
-	_, err := r.db.ExecContext(ctx, query,
+func (r *sqliteRepository) addColumnIfMissing(ctx context.Context, table, column, definition string) error {
+	rows, err := r.db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid          int
+			name, typ    string
+			notNull, pk  int
+			defaultValue sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan column info of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating column info of %s: %w", table, err)
+	}
+	rows.Close()
+
+	_, err = r.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s to %s: %w", column, table, err)
+	}
+	return nil
+}
+
+// Save inserts the transaction and runs hooks in a single SQL transaction.
+func (r *sqliteRepository) Save(ctx context.Context, tx model.Transaction, hooks ...SaveHook) (err error) {
+	sqlTx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction (id: %s): %w", tx.ID, err)
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := sqlTx.Rollback(); rbErr != nil {
+				log.Printf("Repository: Failed to rollback transaction (id: %s): %v", tx.ID, rbErr)
+			}
+		}
+	}()
+
+	var metadata sql.NullString
+	if len(tx.Metadata) > 0 {
+		encoded, err := json.Marshal(tx.Metadata)
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata of transaction (id: %s): %w", tx.ID, err)
+		}
+		metadata = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	query := `INSERT INTO transactions (id, user_id, amount, type, timestamp, status_updated_at,
+        source_account, destination_account, counterparty_id, counterparty_name, channel, metadata)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = sqlTx.ExecContext(ctx, query,
 		tx.ID,
 		tx.UserID,
 		tx.Amount,
 		tx.Type,
 		tx.Timestamp,
+		tx.Timestamp,
+		nullString(tx.SourceAccount),
+		nullString(tx.DestinationAccount),
+		nullString(tx.CounterpartyID),
+		nullString(tx.CounterpartyName),
+		nullString(tx.Channel),
+		metadata,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to insert transaction (id: %s): %w", tx.ID, err)
 	}
+
+	for _, hook := range hooks {
+		if err = hook(ctx, sqlTx, tx); err != nil {
+			return err
+		}
+	}
+
+	if err = sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction (id: %s): %w", tx.ID, err)
+	}
 	return nil
 }
+
+func (r *sqliteRepository) Enqueue(ctx context.Context, transactionID string) error {
+	if _, err := r.db.ExecContext(ctx, insertOutboxEntry, transactionID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to insert outbox entry (id: %s): %w", transactionID, err)
+	}
+	return nil
+}
+
+// nullString stores an empty optional field as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
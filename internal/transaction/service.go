@@ -17,15 +17,18 @@ var (
 )
 
 type Service struct {
-	repo              Repository
-	createdTxnChannel chan<- model.Transaction
+	repo      Repository
+	publisher Publisher
 }
 
-func NewService(repo Repository, createdTxnChannel chan<- model.Transaction) Service {
+func NewService(repo Repository, publisher Publisher) Service {
 	if repo == nil {
 		panic("Repository cannot be nil for transaction.NewService")
 	}
-	return Service{repo: repo, createdTxnChannel: createdTxnChannel}
+	if publisher == nil {
+		panic("Publisher cannot be nil for transaction.NewService")
+	}
+	return Service{repo: repo, publisher: publisher}
 }
 
 func (s *Service) CreateTransaction(ctx context.Context, tx model.Transaction) (model.Transaction, error) {
@@ -45,20 +48,59 @@ func (s *Service) CreateTransaction(ctx context.Context, tx model.Transaction) (
 		return model.Transaction{}, fmt.Errorf("%w: missing required field: user_id", ErrValidation)
 	}
 
+	if tx.Channel != "" && !isValidChannel(tx.Channel) {
+		allowedChannels := fmt.Sprintf("'%s', '%s', '%s', '%s'", model.WebChannel, model.MobileChannel, model.ATMChannel, model.APIChannel)
+		return model.Transaction{}, fmt.Errorf("%w: invalid channel '%s', must be one of [%s]", ErrValidation, tx.Channel, allowedChannels)
+	}
+
+	if tx.Type == model.TransferType && tx.CounterpartyID == "" {
+		return model.Transaction{}, fmt.Errorf("%w: missing required field for a transfer: counterpartyId", ErrValidation)
+	}
+
 	tx.Timestamp = time.Now().UTC()
 	log.Printf("Service: Setting transaction timestamp for ID %s to %s", tx.ID, tx.Timestamp)
 
+	if waiter, ok := s.publisher.(Waiter); ok {
+		if err := waiter.Wait(ctx); err != nil {
+			log.Printf("Service: Publisher not ready for transaction ID %s: %v", tx.ID, err)
+			return model.Transaction{}, fmt.Errorf("failed to publish transaction: %w", err)
+		}
+	}
+
+	var hooks []SaveHook
+	txPublisher, transactional := s.publisher.(TxPublisher)
+	if transactional {
+		hooks = append(hooks, txPublisher.PublishTx)
+	}
+
 	log.Printf("Service: Attempting to save transaction ID %s", tx.ID)
-	err := s.repo.Save(ctx, tx)
+	err := s.repo.Save(ctx, tx, hooks...)
 	if err != nil {
 		log.Printf("Service: Error saving transaction ID %s: %v", tx.ID, err)
 		return model.Transaction{}, fmt.Errorf("failed to save transaction: %w", err)
 	}
-	s.createdTxnChannel <- tx
 	log.Printf("Service: Successfully saved transaction ID %s", tx.ID)
+
+	if !transactional {
+		// The transaction is stored, so the request succeeds either way. If it cannot be published, e.g.
+		// because the queue filled up since Wait, the relay picks it up from the outbox instead.
+		if err := s.publisher.Publish(ctx, tx); err != nil {
+			log.Printf("Service: Error publishing transaction ID %s, falling back to the outbox: %v", tx.ID, err)
+			s.enqueue(tx)
+		}
+	}
 	return tx, nil
 }
 
+// enqueue adds tx to the outbox, independently of the request's context, which may already be done.
+func (s *Service) enqueue(tx model.Transaction) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.repo.Enqueue(ctx, tx.ID); err != nil {
+		log.Printf("Service: Error enqueuing transaction ID %s, leaving it PENDING for boot recovery: %v", tx.ID, err)
+	}
+}
+
 func isValidTransactionType(txType string) bool {
 	switch txType {
 	case model.DepositType, model.WithdrawalType, model.TransferType:
@@ -67,3 +109,12 @@ func isValidTransactionType(txType string) bool {
 		return false
 	}
 }
+
+func isValidChannel(channel string) bool {
+	switch channel {
+	case model.WebChannel, model.MobileChannel, model.ATMChannel, model.APIChannel:
+		return true
+	default:
+		return false
+	}
+}
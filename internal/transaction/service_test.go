@@ -0,0 +1,102 @@
+package transaction
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/jasimvs/sample-go-svc/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestService_CreateTransaction_Validation tests the required fields, including the counterparty of a transfer, and the allowed channels.
+func TestService_CreateTransaction_Validation(t *testing.T) {
+	_, repo, cleanup := setupTestDB(t)
+	defer cleanup()
+	require.NoError(t, repo.Migrate(context.Background()))
+	service := NewService(repo, NewOutboxPublisher())
+
+	tests := []struct {
+		name    string
+		tx      model.Transaction
+		wantErr bool
+	}{
+		{"deposit", model.Transaction{UserID: "user_1", Amount: 10, Type: model.DepositType}, false},
+		{"missing type", model.Transaction{UserID: "user_1", Amount: 10}, true},
+		{"missing user", model.Transaction{Amount: 10, Type: model.DepositType}, true},
+		{"transfer without counterparty", model.Transaction{UserID: "user_1", Amount: 10, Type: model.TransferType}, true},
+		{"transfer", model.Transaction{UserID: "user_1", Amount: 10, Type: model.TransferType, CounterpartyID: "user_2"}, false},
+		{"known channel", model.Transaction{UserID: "user_1", Amount: 10, Type: model.WithdrawalType, Channel: model.ATMChannel}, false},
+		{"unknown channel", model.Transaction{UserID: "user_1", Amount: 10, Type: model.WithdrawalType, Channel: "fax"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created, err := service.CreateTransaction(context.Background(), tt.tx)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrValidation)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotEmpty(t, created.ID)
+			assert.Equal(t, tt.tx.CounterpartyID, created.CounterpartyID)
+		})
+	}
+}
+
+// storedCheckPublisher records, for every published transaction, whether it was already committed.
+type storedCheckPublisher struct {
+	db     *sql.DB
+	stored map[string]bool
+}
+
+func (p *storedCheckPublisher) Publish(ctx context.Context, tx model.Transaction) error {
+	var count int
+	if err := p.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM transactions WHERE id = ?`, tx.ID).Scan(&count); err != nil {
+		return err
+	}
+	p.stored[tx.ID] = count == 1
+	return nil
+}
+
+// TestService_CreateTransaction_PublishAfterCommit tests that non-transactional publishers only see committed transactions.
+func TestService_CreateTransaction_PublishAfterCommit(t *testing.T) {
+	db, repo, cleanup := setupTestDB(t)
+	defer cleanup()
+	require.NoError(t, repo.Migrate(context.Background()))
+	publisher := &storedCheckPublisher{db: db, stored: make(map[string]bool)}
+	service := NewService(repo, publisher)
+
+	created, err := service.CreateTransaction(context.Background(), model.Transaction{UserID: "user_1", Amount: 10, Type: model.DepositType})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{created.ID: true}, publisher.stored)
+
+	_, err = db.Exec(`DROP TABLE transactions`)
+	require.NoError(t, err)
+	_, err = service.CreateTransaction(context.Background(), model.Transaction{UserID: "user_1", Amount: 10, Type: model.DepositType})
+	require.Error(t, err)
+	assert.Len(t, publisher.stored, 1, "A transaction that failed to save must not be published")
+}
+
+// failingPublisher fails every publish, like a QueuePublisher whose queue filled up after Wait.
+type failingPublisher struct{}
+
+func (failingPublisher) Publish(context.Context, model.Transaction) error {
+	return ErrQueueFull
+}
+
+// TestService_CreateTransaction_PublishFails tests that a transaction that is saved but cannot be published
+// is handed to the outbox instead of being left for boot recovery.
+func TestService_CreateTransaction_PublishFails(t *testing.T) {
+	db, repo, cleanup := setupTestDB(t)
+	defer cleanup()
+	require.NoError(t, repo.Migrate(context.Background()))
+	service := NewService(repo, failingPublisher{})
+
+	created, err := service.CreateTransaction(context.Background(), model.Transaction{UserID: "user_1", Amount: 10, Type: model.DepositType})
+	require.NoError(t, err, "The transaction is stored, so the request should succeed")
+
+	var queued int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM transaction_outbox WHERE transaction_id = ?`, created.ID).Scan(&queued))
+	assert.Equal(t, 1, queued)
+}